@@ -4,6 +4,7 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"net/http"
 	"net/url"
 	"strings"
@@ -11,50 +12,83 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
+const (
+	accessPolicyDeny  = "deny"
+	accessPolicyAllow = "allow"
+)
+
+// getDefaultAccessPolicy возвращает политику для пользователей без прав (по умолчанию - запрет)
+func getDefaultAccessPolicy() string {
+	if config != nil && config.Access.DefaultPolicy == accessPolicyAllow {
+		return accessPolicyAllow
+	}
+	return accessPolicyDeny
+}
+
 func checkAccess(username, requestHost, requestPath string, c *gin.Context) bool {
 	requestHost = strings.Split(requestHost, ":")[0]
 
 	// Получаем права пользователя из Valkey
 	permissions, err := GetUserPermissions(username)
 	if err != nil {
-		// Если пользователь не найден или ошибка, разрешаем доступ (можно изменить на запрет)
-		return true
+		// Ошибка Valkey приравнивается к отсутствию прав, решение принимает политика по умолчанию
+		log.Printf("Ошибка получения прав пользователя %s: %v", username, err)
+		permissions = nil
 	}
 
-	// Если прав нет, разрешаем доступ
-	if len(permissions) == 0 {
-		return true
+	// API токен с областями действует только в пределах пересечения областей и прав пользователя,
+	// политика по умолчанию к нему не применяется
+	if scopes, scoped := c.Get("apiTokenScopes"); scoped {
+		permissions = restrictPermissions(permissions, scopes.([]string))
+		if len(permissions) == 0 {
+			denyAccess(c, requestPath)
+			return false
+		}
 	}
 
-	if strings.HasPrefix(requestPath, "/static/") {
+	if len(permissions) > 0 && strings.HasPrefix(requestPath, "/static/") {
 		return checkStaticAccessFromPermissions(permissions, requestHost, requestPath, c)
 	}
 
-	hasAccess := checkPathAccessFromPermissions(permissions, requestHost, requestPath)
-	if !hasAccess {
-		// Проверяем, является ли запрос API запросом
-		acceptHeader := c.GetHeader("Accept")
-		contentType := c.GetHeader("Content-Type")
-		isAPIRequest := strings.Contains(acceptHeader, "application/json") ||
-			strings.Contains(contentType, "application/json") ||
-			strings.HasPrefix(requestPath, "/waiter/") ||
-			strings.HasPrefix(requestPath, "/api/")
-
-		if isAPIRequest {
-			// Для API запросов возвращаем JSON ошибку
-			c.JSON(http.StatusForbidden, gin.H{
-				"detail": "Доступ запрещен. Недостаточно прав для доступа к этому ресурсу.",
-			})
-		} else {
-			// Для обычных запросов делаем редирект
-			redirectToMainPage(c)
-		}
+	if !evaluateAccess(getDefaultAccessPolicy(), permissions, requestHost, requestPath) {
+		denyAccess(c, requestPath)
 		return false
 	}
 
 	return true
 }
 
+// evaluateAccess принимает решение о доступе: при отсутствии прав действует политика по умолчанию
+func evaluateAccess(policy string, permissions []string, requestHost, requestPath string) bool {
+	if len(permissions) == 0 {
+		return policy == accessPolicyAllow
+	}
+	return checkPathAccessFromPermissions(permissions, requestHost, requestPath)
+}
+
+// isAPIRequest определяет, ожидает ли клиент JSON ответ вместо HTML страницы
+func isAPIRequest(c *gin.Context, requestPath string) bool {
+	acceptHeader := c.GetHeader("Accept")
+	contentType := c.GetHeader("Content-Type")
+	return strings.Contains(acceptHeader, "application/json") ||
+		strings.Contains(contentType, "application/json") ||
+		strings.HasPrefix(requestPath, "/waiter/") ||
+		strings.HasPrefix(requestPath, "/api/")
+}
+
+// denyAccess отвечает на запрещенный запрос: JSON 403 для API, редирект на главную для браузера
+func denyAccess(c *gin.Context, requestPath string) {
+	if isAPIRequest(c, requestPath) {
+		// Для API запросов возвращаем JSON ошибку
+		c.JSON(http.StatusForbidden, gin.H{
+			"detail": "Доступ запрещен. Недостаточно прав для доступа к этому ресурсу.",
+		})
+	} else {
+		// Для обычных запросов делаем редирект
+		redirectToMainPage(c)
+	}
+}
+
 func checkPathAccessFromPermissions(permissions []string, requestHost, requestPath string) bool {
 	for _, allowed := range permissions {
 		if strings.Contains(allowed, "/") {
@@ -109,4 +143,3 @@ func redirectToMainPage(c *gin.Context) {
 	mainURL := fmt.Sprintf("https://%s:%d/", defaultHost, port)
 	c.Redirect(http.StatusFound, mainURL)
 }
-
@@ -0,0 +1,84 @@
+package main
+
+import "testing"
+
+func TestCheckPathAccessFromPermissions(t *testing.T) {
+	tests := []struct {
+		name        string
+		permissions []string
+		host        string
+		path        string
+		want        bool
+	}{
+		{"хост и путь совпадают", []string{"rest.secure-proxy.lan/kitchen"}, "rest.secure-proxy.lan", "/kitchen/orders", true},
+		{"другой путь на том же хосте", []string{"rest.secure-proxy.lan/kitchen"}, "rest.secure-proxy.lan", "/warehouse", false},
+		{"тот же путь на другом хосте", []string{"rest.secure-proxy.lan/kitchen"}, "other.secure-proxy.lan", "/kitchen", false},
+		{"только хост", []string{"rest.secure-proxy.lan"}, "rest.secure-proxy.lan", "/anything", true},
+		{"только хост, другой хост", []string{"rest.secure-proxy.lan"}, "other.secure-proxy.lan", "/", false},
+		{"одно из нескольких прав", []string{"rest.secure-proxy.lan/kitchen", "rest.secure-proxy.lan/waiter"}, "rest.secure-proxy.lan", "/waiter", true},
+		{"право администратора не дает доступа к сервисам", []string{defaultAdminPermission}, "rest.secure-proxy.lan", "/kitchen", false},
+		{"без прав", nil, "rest.secure-proxy.lan", "/kitchen", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := checkPathAccessFromPermissions(tt.permissions, tt.host, tt.path)
+			if got != tt.want {
+				t.Errorf("checkPathAccessFromPermissions(%v, %q, %q) = %v, want %v", tt.permissions, tt.host, tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvaluateAccess(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      string
+		permissions []string
+		path        string
+		want        bool
+	}{
+		{"deny: нет ролей", accessPolicyDeny, nil, "/kitchen", false},
+		{"deny: пустой набор прав", accessPolicyDeny, []string{}, "/", false},
+		{"deny: есть право", accessPolicyDeny, []string{"rest.secure-proxy.lan/kitchen"}, "/kitchen", true},
+		{"deny: нет нужного права", accessPolicyDeny, []string{"rest.secure-proxy.lan/kitchen"}, "/warehouse", false},
+		{"allow: нет ролей", accessPolicyAllow, nil, "/kitchen", true},
+		{"allow: пустой набор прав", accessPolicyAllow, []string{}, "/", true},
+		{"allow: есть право", accessPolicyAllow, []string{"rest.secure-proxy.lan/kitchen"}, "/kitchen", true},
+		{"allow: нет нужного права", accessPolicyAllow, []string{"rest.secure-proxy.lan/kitchen"}, "/warehouse", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := evaluateAccess(tt.policy, tt.permissions, "rest.secure-proxy.lan", tt.path)
+			if got != tt.want {
+				t.Errorf("evaluateAccess(%q, %v, %q) = %v, want %v", tt.policy, tt.permissions, tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetDefaultAccessPolicy(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+
+	tests := []struct {
+		name   string
+		config *Config
+		want   string
+	}{
+		{"без конфигурации", nil, accessPolicyDeny},
+		{"политика не указана", &Config{}, accessPolicyDeny},
+		{"deny", &Config{Access: AccessConfig{DefaultPolicy: accessPolicyDeny}}, accessPolicyDeny},
+		{"allow", &Config{Access: AccessConfig{DefaultPolicy: accessPolicyAllow}}, accessPolicyAllow},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = tt.config
+			if got := getDefaultAccessPolicy(); got != tt.want {
+				t.Errorf("getDefaultAccessPolicy() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+// Package main - аутентификация и авторизация администраторов.
+// Содержит выдачу админ-сессий и middleware для защиты админ-панели и API управления.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/valkey-io/valkey-go"
+)
+
+const (
+	defaultAdminPermission  = "secure-proxy:admin"
+	defaultAdminCookieName  = "SECURE_PROXY_ADMIN_SESSION"
+	adminSessionPrefix      = "admin:session:"
+	userAdminSessionsPrefix = "user:admin-sessions:"
+)
+
+// getAdminSessionKey возвращает ключ хранения админ-сессии в Valkey
+func getAdminSessionKey(sessionKey string) string {
+	return adminSessionPrefix + sessionKey
+}
+
+// getUserAdminSessionsKey возвращает ключ индекса админ-сессий пользователя
+func getUserAdminSessionsKey(username string) string {
+	return userAdminSessionsPrefix + username
+}
+
+func getAdminPermission() string {
+	if config != nil && config.Admin.Permission != "" {
+		return config.Admin.Permission
+	}
+	return defaultAdminPermission
+}
+
+func getAdminCookieName() string {
+	if config != nil && config.Admin.CookieName != "" {
+		return config.Admin.CookieName
+	}
+	return defaultAdminCookieName
+}
+
+// isAdminPermission проверяет, является ли право правом администратора (а не адресом сервиса)
+func isAdminPermission(permission string) bool {
+	return permission == getAdminPermission()
+}
+
+// isAdminUser проверяет наличие права администратора у пользователя
+func isAdminUser(username string) (bool, error) {
+	return CheckUserPermission(username, getAdminPermission())
+}
+
+// issueAdminSession создает админ-сессию, если у пользователя есть право администратора.
+// Админ-сессия хранится отдельно от обычной и выдается только для auth-хоста.
+func issueAdminSession(c *gin.Context, username string) error {
+	isAdmin, err := isAdminUser(username)
+	if err != nil || !isAdmin {
+		return err
+	}
+
+	sessionKey := generateSessionKey()
+	adminSessionKey := getAdminSessionKey(sessionKey)
+	userAdminSessionsKey := getUserAdminSessionsKey(username)
+	createdAt := time.Now()
+	ttl := sessionRemainingTTL(createdAt, createdAt, getSessionIdleTimeout(), getSessionAbsoluteTimeout())
+
+	// Индекс нужен, чтобы завершение всех сессий пользователя закрывало и админ-панель.
+	// Админ-сессии живут не дольше предельного срока, поэтому индекс истекает вместе с последней из них.
+	ctx := context.Background()
+	for _, result := range valkeyClient.DoMulti(ctx,
+		valkeyClient.B().Hset().Key(adminSessionKey).FieldValue().
+			FieldValue(sessionFieldUsername, username).
+			FieldValue(sessionFieldCreatedAt, strconv.FormatInt(createdAt.Unix(), 10)).
+			Build(),
+		valkeyClient.B().Expire().Key(adminSessionKey).Seconds(ttlSeconds(ttl)).Build(),
+		valkeyClient.B().Sadd().Key(userAdminSessionsKey).Member(sessionKey).Build(),
+		valkeyClient.B().Expire().Key(userAdminSessionsKey).Seconds(ttlSeconds(getSessionAbsoluteTimeout())).Build(),
+	) {
+		if err := result.Error(); err != nil {
+			return fmt.Errorf("ошибка сохранения админ-сессии: %v", err)
+		}
+	}
+
+	c.SetSameSite(getSessionSameSite())
+	c.SetCookie(
+		getAdminCookieName(),
+		sessionKey,
+		int(ttlSeconds(getSessionAbsoluteTimeout())),
+		"/",
+		"",
+		true,
+		true,
+	)
+	return nil
+}
+
+// deleteAdminSession удаляет админ-сессию и убирает ее из индекса пользователя
+func deleteAdminSession(sessionKey string) error {
+	ctx := context.Background()
+	adminSessionKey := getAdminSessionKey(sessionKey)
+
+	username, err := valkeyClient.Do(ctx, valkeyClient.B().Hget().Key(adminSessionKey).Field(sessionFieldUsername).Build()).ToString()
+	if err != nil && !valkey.IsValkeyNil(err) {
+		return fmt.Errorf("ошибка чтения админ-сессии: %v", err)
+	}
+
+	if err := valkeyClient.Do(ctx, valkeyClient.B().Del().Key(adminSessionKey).Build()).Error(); err != nil {
+		return fmt.Errorf("ошибка удаления админ-сессии: %v", err)
+	}
+	if username != "" {
+		removeFromIndex(ctx, getUserAdminSessionsKey(username), sessionKey)
+	}
+	return nil
+}
+
+// resolveAdminSession возвращает имя администратора текущего запроса.
+// Второе значение - HTTP статус ошибки: 401 без сессии, 403 без права администратора.
+func resolveAdminSession(c *gin.Context) (string, int) {
+	sessionKey, err := c.Cookie(getAdminCookieName())
+	if err != nil || sessionKey == "" {
+		return "", http.StatusUnauthorized
+	}
+
+	ctx := context.Background()
+	adminSessionKey := getAdminSessionKey(sessionKey)
+	fields, err := valkeyClient.Do(ctx, valkeyClient.B().Hgetall().Key(adminSessionKey).Build()).AsStrMap()
+	if err != nil || fields[sessionFieldUsername] == "" {
+		return "", http.StatusUnauthorized
+	}
+	username := fields[sessionFieldUsername]
+
+	// Админ-сессия подчиняется тем же срокам простоя и предельному сроку, что и обычная
+	ttl := sessionRemainingTTL(parseUnixField(fields[sessionFieldCreatedAt]), time.Now(), getSessionIdleTimeout(), getSessionAbsoluteTimeout())
+	if ttl <= 0 {
+		deleteAdminSession(sessionKey)
+		return "", http.StatusUnauthorized
+	}
+
+	// Право проверяется на каждый запрос, чтобы отзыв роли действовал сразу
+	isAdmin, err := isAdminUser(username)
+	if err != nil || !isAdmin {
+		return username, http.StatusForbidden
+	}
+
+	valkeyClient.Do(ctx, valkeyClient.B().Expire().Key(adminSessionKey).Seconds(ttlSeconds(ttl)).Build())
+	return username, http.StatusOK
+}
+
+// adminAPIMiddleware защищает API управления, отвечая JSON ошибками 401/403
+func adminAPIMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, status := resolveAdminSession(c)
+		switch status {
+		case http.StatusUnauthorized:
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Требуется вход администратора"})
+			return
+		case http.StatusForbidden:
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Недостаточно прав администратора"})
+			return
+		}
+
+		c.Set("adminUsername", username)
+		c.Next()
+	}
+}
+
+// adminPageMiddleware защищает страницу админ-панели, перенаправляя на вход при отсутствии сессии
+func adminPageMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, status := resolveAdminSession(c)
+		switch status {
+		case http.StatusUnauthorized:
+			redirectUrl := fmt.Sprintf("https://%s%s", c.Request.Host, c.Request.URL.String())
+			c.Redirect(http.StatusFound, "/?redirectUrl="+url.QueryEscape(redirectUrl))
+			c.Abort()
+			return
+		case http.StatusForbidden:
+			c.String(http.StatusForbidden, "Недостаточно прав администратора")
+			c.Abort()
+			return
+		}
+
+		c.Set("adminUsername", username)
+		c.Next()
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+)
+
+// setupAdminSession выдает администратору manager админ-сессию и возвращает ее cookie
+func setupAdminSession(t *testing.T) (*miniredis.Miniredis, *http.Cookie) {
+	t.Helper()
+	server := setupTestValkey(t)
+	if err := SetRolePermissions("admin", []string{getAdminPermission()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveUser("manager", "", []string{"admin"}); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "https://auth.secure-proxy.lan/login", nil)
+	if err := issueAdminSession(c, "manager"); err != nil {
+		t.Fatal(err)
+	}
+	for _, cookie := range recorder.Result().Cookies() {
+		if cookie.Name == getAdminCookieName() {
+			return server, cookie
+		}
+	}
+	t.Fatal("админ-сессия не выдана")
+	return nil, nil
+}
+
+func TestAdminMiddleware(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	tests := []struct {
+		name     string
+		prepare  func(t *testing.T, server *miniredis.Miniredis, cookie *http.Cookie) *http.Cookie
+		wantAPI  int
+		wantPage int
+	}{
+		{
+			"действующая сессия",
+			func(t *testing.T, server *miniredis.Miniredis, cookie *http.Cookie) *http.Cookie { return cookie },
+			http.StatusOK, http.StatusOK,
+		},
+		{
+			"без cookie",
+			func(t *testing.T, server *miniredis.Miniredis, cookie *http.Cookie) *http.Cookie { return nil },
+			http.StatusUnauthorized, http.StatusFound,
+		},
+		{
+			"право администратора отозвано",
+			func(t *testing.T, server *miniredis.Miniredis, cookie *http.Cookie) *http.Cookie {
+				if err := SetRolePermissions("admin", []string{"rest.secure-proxy.lan/kitchen"}); err != nil {
+					t.Fatal(err)
+				}
+				return cookie
+			},
+			http.StatusForbidden, http.StatusForbidden,
+		},
+		{
+			"истек предельный срок сессии",
+			func(t *testing.T, server *miniredis.Miniredis, cookie *http.Cookie) *http.Cookie {
+				createdAt := time.Now().Add(-getSessionAbsoluteTimeout() - time.Minute)
+				server.HSet(getAdminSessionKey(cookie.Value), sessionFieldCreatedAt, strconv.FormatInt(createdAt.Unix(), 10))
+				return cookie
+			},
+			http.StatusUnauthorized, http.StatusFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, cookie := setupAdminSession(t)
+			cookie = tt.prepare(t, server, cookie)
+
+			engine := gin.New()
+			engine.GET("/api/users", adminAPIMiddleware(), func(c *gin.Context) { c.String(http.StatusOK, c.GetString("adminUsername")) })
+			engine.GET("/admin", adminPageMiddleware(), func(c *gin.Context) { c.String(http.StatusOK, c.GetString("adminUsername")) })
+
+			for _, check := range []struct {
+				path string
+				want int
+			}{{"/api/users", tt.wantAPI}, {"/admin", tt.wantPage}} {
+				req := httptest.NewRequest(http.MethodGet, "https://auth.secure-proxy.lan"+check.path, nil)
+				if cookie != nil {
+					req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+				}
+				recorder := httptest.NewRecorder()
+				engine.ServeHTTP(recorder, req)
+
+				if recorder.Code != check.want {
+					t.Errorf("%s: статус %d, want %d", check.path, recorder.Code, check.want)
+				}
+				if check.want == http.StatusOK && recorder.Body.String() != "manager" {
+					t.Errorf("%s: администратор %q, want manager", check.path, recorder.Body.String())
+				}
+				if check.want == http.StatusFound && !strings.HasPrefix(recorder.Header().Get("Location"), "/?redirectUrl=") {
+					t.Errorf("%s: Location %q, want страницу входа", check.path, recorder.Header().Get("Location"))
+				}
+			}
+		})
+	}
+}
+
+func TestHandleLogoutEndsAdminSession(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+	server, cookie := setupAdminSession(t)
+	saved := config
+	config = &Config{Sessions: SessionsConfig{CookieName: "SECURE_PROXY_SESSION", CookieDomain: ".secure-proxy.lan"}}
+	t.Cleanup(func() { config = saved })
+
+	engine := gin.New()
+	engine.GET("/logout", handleLogout)
+	req := httptest.NewRequest(http.MethodGet, "https://auth.secure-proxy.lan/logout", nil)
+	req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, req)
+
+	if server.Exists(getAdminSessionKey(cookie.Value)) {
+		t.Error("админ-сессия не удалена при выходе")
+	}
+	if members, _ := server.SMembers(getUserAdminSessionsKey("manager")); len(members) != 0 {
+		t.Errorf("индекс админ-сессий = %v, want пустой", members)
+	}
+
+	cleared := false
+	for _, c := range recorder.Result().Cookies() {
+		if c.Name == getAdminCookieName() && c.MaxAge < 0 && c.Domain == "" {
+			cleared = true
+		}
+	}
+	if !cleared {
+		t.Errorf("cookie админ-сессии не очищена: %v", recorder.Header().Values("Set-Cookie"))
+	}
+}
@@ -1,25 +1,40 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"image/png"
 	"net/http"
-	"regexp"
+	"net/url"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/pquerna/otp/totp"
 )
 
 type UserResponse struct {
 	Username     string   `json:"username"`
-	TOTPSecret   string   `json:"totpSecret"`
-	TOTPCode     string   `json:"totpCode"`
+	TOTPEnrolled bool     `json:"totpEnrolled"`
 	AllowedPaths []string `json:"allowedPaths"`
 	Roles        []string `json:"roles"`
 	Permissions  []string `json:"permissions"`
 }
 
+// UserEnrollmentResponse возвращается при создании пользователя: TOTP подключается
+// по otpauth URI или одноразовому QR коду, секрет отдельным полем не передается
+type UserEnrollmentResponse struct {
+	UserResponse
+	TOTPURI   string `json:"totpUri"`
+	TOTPQRURL string `json:"totpQrUrl"`
+}
+
+// UserSecretResponse возвращается только при явном сбросе TOTP.
+// Это единственный момент, когда секрет покидает сервер в открытом виде.
+type UserSecretResponse struct {
+	UserEnrollmentResponse
+	TOTPSecret string `json:"totpSecret"`
+}
+
 type CreateUserRequest struct {
 	Username     string   `json:"username" binding:"required"`
 	AllowedPaths []string `json:"allowedPaths"`
@@ -36,10 +51,64 @@ type CreateRoleRequest struct {
 	Permissions []string `json:"permissions"`
 }
 
+type CreateAPITokenRequest struct {
+	Name          string   `json:"name" binding:"required"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expiresInDays"`
+}
+
+type APITokenResponse struct {
+	ID        string     `json:"id"`
+	Username  string     `json:"username"`
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt time.Time  `json:"expiresAt"`
+	LastUsed  *time.Time `json:"lastUsed"`
+	CreatedBy string     `json:"createdBy"`
+}
+
+// APITokenSecretResponse возвращается только при выпуске токена
+type APITokenSecretResponse struct {
+	APITokenResponse
+	Token string `json:"token"`
+}
+
 type SessionResponse struct {
-	Key      string `json:"key"`
-	Username string `json:"username"`
-	TTL      int64  `json:"ttl"`
+	Key         string    `json:"key"`
+	Username    string    `json:"username"`
+	TTL         int64     `json:"ttl"`
+	CreatedAt   time.Time `json:"createdAt"`
+	LastSeen    time.Time `json:"lastSeen"`
+	ClientIP    string    `json:"clientIp"`
+	UserAgent   string    `json:"userAgent"`
+	LoginMethod string    `json:"loginMethod"`
+	BindMode    string    `json:"bindMode,omitempty"`
+
+	Evicted       bool       `json:"evicted"`
+	EvictedAt     *time.Time `json:"evictedAt,omitempty"`
+	EvictedReason string     `json:"evictedReason,omitempty"`
+}
+
+func newSessionResponse(session *Session, ttl int64) SessionResponse {
+	response := SessionResponse{
+		Key:         session.ID,
+		Username:    session.Username,
+		TTL:         ttl,
+		CreatedAt:   session.CreatedAt,
+		LastSeen:    session.LastSeen,
+		ClientIP:    session.ClientIP,
+		UserAgent:   session.UserAgent,
+		LoginMethod: session.LoginMethod,
+		BindMode:    session.BindMode,
+	}
+	if session.Evicted() {
+		evictedAt := session.EvictedAt
+		response.Evicted = true
+		response.EvictedAt = &evictedAt
+		response.EvictedReason = session.EvictedReason
+	}
+	return response
 }
 
 func handleGetUsers(c *gin.Context) {
@@ -52,21 +121,23 @@ func handleGetUsers(c *gin.Context) {
 
 	users := make([]UserResponse, 0, len(valkeyUsers))
 	for username, user := range valkeyUsers {
-		totpCode, _ := totp.GenerateCode(user.TOTPSecret, time.Now())
-		permissions, _ := GetUserPermissions(username)
-
-		users = append(users, UserResponse{
-			Username:     username,
-			TOTPSecret:   user.TOTPSecret,
-			TOTPCode:     totpCode,
-			AllowedPaths: permissions, // Для обратной совместимости
-			Roles:        user.Roles,
-			Permissions:  permissions,
-		})
+		users = append(users, newUserResponse(username, user.TOTPSecret, user.Roles))
 	}
 	c.JSON(http.StatusOK, users)
 }
 
+// newUserResponse формирует ответ о пользователе без TOTP секрета
+func newUserResponse(username, totpSecret string, roles []string) UserResponse {
+	permissions, _ := GetUserPermissions(username)
+	return UserResponse{
+		Username:     username,
+		TOTPEnrolled: totpSecret != "",
+		AllowedPaths: permissions, // Для обратной совместимости
+		Roles:        roles,
+		Permissions:  permissions,
+	}
+}
+
 func handleCreateUser(c *gin.Context) {
 	var req CreateUserRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -91,15 +162,12 @@ func handleCreateUser(c *gin.Context) {
 		return
 	}
 
-	permissions, _ := GetUserPermissions(req.Username)
-	c.JSON(http.StatusOK, UserResponse{
-		Username:     req.Username,
-		TOTPSecret:   totpSecret,
-		TOTPCode:     "",
-		AllowedPaths: permissions,
-		Roles:        roles,
-		Permissions:  permissions,
-	})
+	response, err := newUserEnrollmentResponse(req.Username, totpSecret, roles)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, response)
 }
 
 func handleUpdateUser(c *gin.Context) {
@@ -127,16 +195,98 @@ func handleUpdateUser(c *gin.Context) {
 		return
 	}
 
-	totpCode, _ := totp.GenerateCode(user.TOTPSecret, time.Now())
-	permissions, _ := GetUserPermissions(username)
-	c.JSON(http.StatusOK, UserResponse{
-		Username:     username,
-		TOTPSecret:   user.TOTPSecret,
-		TOTPCode:     totpCode,
-		AllowedPaths: permissions,
-		Roles:        roles,
-		Permissions:  permissions,
-	})
+	// При смене ролей пользователь должен войти заново с новым набором прав
+	if !sameRoles(user.Roles, roles) {
+		if _, err := RevokeUserSessions(username); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Роли обновлены, но сессии не завершены: " + err.Error()})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, newUserResponse(username, user.TOTPSecret, roles))
+}
+
+func handleResetUserTOTP(c *gin.Context) {
+	username := c.Param("username")
+
+	user, err := GetUser(username)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Пользователь не найден"})
+		return
+	}
+
+	totpSecret := generateTOTPSecret()
+	err = SaveUser(username, totpSecret, user.Roles)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка сброса TOTP: " + err.Error()})
+		return
+	}
+
+	// Шаг последнего принятого кода относится к старому секрету
+	ctx := context.Background()
+	valkeyClient.Do(ctx, valkeyClient.B().Del().Key(getUserTOTPLastStepKey(username)).Build())
+
+	enrollment, err := newUserEnrollmentResponse(username, totpSecret, user.Roles)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, UserSecretResponse{UserEnrollmentResponse: enrollment, TOTPSecret: totpSecret})
+}
+
+// newUserEnrollmentResponse формирует ответ для подключения нового секрета и разрешает однократно получить QR код
+func newUserEnrollmentResponse(username, totpSecret string, roles []string) (UserEnrollmentResponse, error) {
+	key, err := buildTOTPKey(username, totpSecret)
+	if err != nil {
+		return UserEnrollmentResponse{}, err
+	}
+
+	if err := AllowTOTPQR(username); err != nil {
+		return UserEnrollmentResponse{}, fmt.Errorf("ошибка подготовки QR кода: %v", err)
+	}
+
+	return UserEnrollmentResponse{
+		UserResponse: newUserResponse(username, totpSecret, roles),
+		TOTPURI:      key.URL(),
+		TOTPQRURL:    "/api/users/" + url.PathEscape(username) + "/totp/qr.png",
+	}, nil
+}
+
+func handleGetUserTOTPQR(c *gin.Context) {
+	username := c.Param("username")
+
+	user, err := GetUser(username)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Пользователь не найден"})
+		return
+	}
+
+	// QR код содержит секрет, поэтому выдается один раз после создания или сброса
+	if !ConsumeTOTPQR(username) {
+		c.JSON(http.StatusGone, gin.H{"error": "QR код уже был получен или истек. Сбросьте TOTP, чтобы получить новый"})
+		return
+	}
+
+	key, err := buildTOTPKey(username, user.TOTPSecret)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	img, err := key.Image(256, 256)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка построения QR кода: " + err.Error()})
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка кодирования QR кода: " + err.Error()})
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Data(http.StatusOK, "image/png", buf.Bytes())
 }
 
 func handleDeleteUser(c *gin.Context) {
@@ -156,65 +306,183 @@ func handleDeleteUser(c *gin.Context) {
 		return
 	}
 
+	if _, err := RevokeUserSessions(username); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Пользователь удален, но сессии не завершены: " + err.Error()})
+		return
+	}
+
+	if _, err := RevokeUserAPITokens(username); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Пользователь удален, но API токены не отозваны: " + err.Error()})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{"message": "Пользователь удален"})
 }
 
-func handleGetSessions(c *gin.Context) {
-	sessions, err := getAllSessions()
+func handleDeleteUserSessions(c *gin.Context) {
+	username := c.Param("username")
+
+	revoked, err := RevokeUserSessions(username)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, sessions)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Сессии пользователя завершены", "revoked": revoked})
 }
 
-func handleDeleteSession(c *gin.Context) {
-	sessionKey := c.Param("key")
-	ctx := context.Background()
+func newAPITokenResponse(token *APIToken) APITokenResponse {
+	response := APITokenResponse{
+		ID:        token.ID,
+		Username:  token.Username,
+		Name:      token.Name,
+		Scopes:    token.Scopes,
+		CreatedAt: token.CreatedAt,
+		ExpiresAt: token.ExpiresAt,
+		CreatedBy: token.CreatedBy,
+	}
+	if response.Scopes == nil {
+		response.Scopes = []string{}
+	}
+	if !token.LastUsed.IsZero() {
+		lastUsed := token.LastUsed
+		response.LastUsed = &lastUsed
+	}
+	return response
+}
+
+func handleCreateAPIToken(c *gin.Context) {
+	username := c.Param("username")
+
+	var req CreateAPITokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	err := valkeyClient.Do(ctx, valkeyClient.B().Del().Key(sessionKey).Build()).Error()
+	exists, err := UserExists(username)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Пользователь не найден"})
+		return
+	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Session deleted"})
-}
+	// Токен может сузить права пользователя, но не расширить их
+	if len(req.Scopes) > 0 {
+		permissions, err := GetUserPermissions(username)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		for _, scope := range req.Scopes {
+			if isAdminPermission(scope) || len(restrictPermissions(permissions, []string{scope})) == 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "У пользователя нет права " + scope})
+				return
+			}
+		}
+	}
 
-func getAllSessions() ([]SessionResponse, error) {
-	ctx := context.Background()
-	var sessions []SessionResponse
+	adminUsername := c.GetString("adminUsername")
+	token, rawToken, err := CreateAPIToken(username, req.Name, req.Scopes, getAPITokenLifetime(req.ExpiresInDays), adminUsername)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
-	sessionKeyPattern := regexp.MustCompile(`^[0-9a-f]{64}$`)
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusCreated, APITokenSecretResponse{
+		APITokenResponse: newAPITokenResponse(token),
+		Token:            rawToken,
+	})
+}
 
-	keysResult := valkeyClient.Do(ctx, valkeyClient.B().Keys().Pattern("*").Build())
-	keys, err := keysResult.AsStrSlice()
+func handleGetAPITokens(c *gin.Context) {
+	tokens, err := GetUserAPITokens(c.Param("username"))
 	if err != nil {
-		return nil, fmt.Errorf("ошибка получения ключей: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 
-	for _, key := range keys {
-		if sessionKeyPattern.MatchString(key) {
-			username, err := valkeyClient.Do(ctx, valkeyClient.B().Get().Key(key).Build()).ToString()
-			if err != nil {
-				continue
-			}
+	response := make([]APITokenResponse, 0, len(tokens))
+	for _, token := range tokens {
+		response = append(response, newAPITokenResponse(token))
+	}
+	c.JSON(http.StatusOK, response)
+}
 
-			ttlResult := valkeyClient.Do(ctx, valkeyClient.B().Ttl().Key(key).Build())
-			ttl, err := ttlResult.AsInt64()
-			if err != nil {
-				ttl = -1
-			}
+func handleDeleteAPIToken(c *gin.Context) {
+	revoked, err := RevokeAPIToken(c.Param("username"), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !revoked {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Токен не найден"})
+		return
+	}
 
-			sessions = append(sessions, SessionResponse{
-				Key:      key,
-				Username: username,
-				TTL:      ttl,
-			})
+	c.JSON(http.StatusOK, gin.H{"message": "Токен отозван"})
+}
+
+// sameRoles сравнивает наборы ролей без учета порядка
+func sameRoles(a, b []string) bool {
+	set := make(map[string]bool, len(a))
+	for _, role := range a {
+		set[role] = true
+	}
+	other := make(map[string]bool, len(b))
+	for _, role := range b {
+		if !set[role] {
+			return false
 		}
+		other[role] = true
 	}
+	return len(set) == len(other)
+}
 
-	return sessions, nil
+func handleGetSessions(c *gin.Context) {
+	sessions, err := GetAllSessions()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, sessions)
+}
+
+func handleDeleteSession(c *gin.Context) {
+	err := DeleteSession(c.Param("key"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Session deleted"})
+}
+
+func handleGetUpstreams(c *gin.Context) {
+	c.JSON(http.StatusOK, GetUpstreamStats())
+}
+
+func handleGetLockouts(c *gin.Context) {
+	lockouts, err := GetAllLockouts()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, lockouts)
+}
+
+func handleDeleteLockout(c *gin.Context) {
+	err := ClearLockout(c.Param("scope"), c.Param("identifier"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Блокировка снята"})
 }
 
 // Обработчики для ролей
@@ -244,14 +512,14 @@ func handleCreateRole(c *gin.Context) {
 	}
 
 	// Проверяем, существует ли роль
-	_, err := GetRolePermissions(req.Name)
-	if err == nil {
-		// Роль уже существует, проверяем через GetAllRoles
-		roles, _ := GetAllRoles()
-		if _, exists := roles[req.Name]; exists {
-			c.JSON(http.StatusConflict, gin.H{"error": "Роль уже существует"})
-			return
-		}
+	exists, err := RoleExists(req.Name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if exists {
+		c.JSON(http.StatusConflict, gin.H{"error": "Роль уже существует"})
+		return
 	}
 
 	err = SetRolePermissions(req.Name, req.Permissions)
@@ -275,14 +543,14 @@ func handleUpdateRole(c *gin.Context) {
 	}
 
 	// Проверяем, существует ли роль
-	_, err := GetRolePermissions(roleName)
+	exists, err := RoleExists(roleName)
 	if err != nil {
-		// Роль не существует
-		roles, _ := GetAllRoles()
-		if _, exists := roles[roleName]; !exists {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Роль не найдена"})
-			return
-		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Роль не найдена"})
+		return
 	}
 
 	err = SetRolePermissions(roleName, req.Permissions)
@@ -312,15 +580,20 @@ func handleDeleteRole(c *gin.Context) {
 func handleGetRole(c *gin.Context) {
 	roleName := c.Param("name")
 
+	exists, err := RoleExists(roleName)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Роль не найдена"})
+		return
+	}
+
 	permissions, err := GetRolePermissions(roleName)
 	if err != nil {
-		// Проверяем через GetAllRoles
-		roles, _ := GetAllRoles()
-		if _, exists := roles[roleName]; !exists {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Роль не найдена"})
-			return
-		}
-		permissions = roles[roleName]
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 
 	c.JSON(http.StatusOK, RoleResponse{
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newTestAPI поднимает маршруты управления пользователями без проверки админ-сессии
+func newTestAPI(t *testing.T) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.ReleaseMode)
+	setupTestValkey(t)
+
+	engine := gin.New()
+	api := engine.Group("/api")
+	api.GET("/users", handleGetUsers)
+	api.POST("/users", handleCreateUser)
+	api.PUT("/users/:username", handleUpdateUser)
+	api.POST("/users/:username/totp/reset", handleResetUserTOTP)
+	api.GET("/users/:username/totp/qr.png", handleGetUserTOTPQR)
+	return engine
+}
+
+// serveTestAPI выполняет запрос к API и возвращает ответ
+func serveTestAPI(engine *gin.Engine, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "https://auth.secure-proxy.lan"+path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestUserResponsesHideTOTPSecret(t *testing.T) {
+	engine := newTestAPI(t)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+	}{
+		{"создание", http.MethodPost, "/api/users", `{"username":"waiter","roles":["waiter"]}`},
+		{"список", http.MethodGet, "/api/users", ""},
+		{"обновление", http.MethodPut, "/api/users/waiter", `{"username":"waiter","roles":["waiter","kitchen"]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := serveTestAPI(engine, tt.method, tt.path, tt.body)
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("статус %d: %s", recorder.Code, recorder.Body.String())
+			}
+
+			var users []map[string]any
+			if strings.HasPrefix(recorder.Body.String(), "[") {
+				err := json.Unmarshal(recorder.Body.Bytes(), &users)
+				if err != nil || len(users) != 1 {
+					t.Fatalf("ответ %s: %v", recorder.Body.String(), err)
+				}
+			} else {
+				users = make([]map[string]any, 1)
+				if err := json.Unmarshal(recorder.Body.Bytes(), &users[0]); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			user := users[0]
+			for _, field := range []string{"totpSecret", "totpCode"} {
+				if _, ok := user[field]; ok {
+					t.Errorf("ответ содержит поле %s: %v", field, user)
+				}
+			}
+			if user["totpEnrolled"] != true {
+				t.Errorf("totpEnrolled = %v, want true", user["totpEnrolled"])
+			}
+
+			// Кроме подключения при создании, секрет не встречается в ответе ни в каком виде
+			stored, err := GetUser("waiter")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.method != http.MethodPost && strings.Contains(recorder.Body.String(), stored.TOTPSecret) {
+				t.Errorf("ответ содержит TOTP секрет: %s", recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestGetUserTOTPQROnce(t *testing.T) {
+	engine := newTestAPI(t)
+
+	// Шаги идут по порядку: QR выдается один раз после создания и после каждого сброса
+	steps := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		wantPNG    bool
+	}{
+		{"QR до создания пользователя", http.MethodGet, "/api/users/waiter/totp/qr.png", "", http.StatusNotFound, false},
+		{"создание", http.MethodPost, "/api/users", `{"username":"waiter"}`, http.StatusOK, false},
+		{"QR после создания", http.MethodGet, "/api/users/waiter/totp/qr.png", "", http.StatusOK, true},
+		{"повторный запрос QR", http.MethodGet, "/api/users/waiter/totp/qr.png", "", http.StatusGone, false},
+		{"сброс TOTP", http.MethodPost, "/api/users/waiter/totp/reset", "", http.StatusOK, false},
+		{"QR после сброса", http.MethodGet, "/api/users/waiter/totp/qr.png", "", http.StatusOK, true},
+		{"повторный запрос QR после сброса", http.MethodGet, "/api/users/waiter/totp/qr.png", "", http.StatusGone, false},
+	}
+
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			recorder := serveTestAPI(engine, step.method, step.path, step.body)
+			if recorder.Code != step.wantStatus {
+				t.Fatalf("статус %d, want %d: %s", recorder.Code, step.wantStatus, recorder.Body.String())
+			}
+			if !step.wantPNG {
+				return
+			}
+			if contentType := recorder.Header().Get("Content-Type"); contentType != "image/png" {
+				t.Errorf("Content-Type = %q, want image/png", contentType)
+			}
+			if recorder.Header().Get("Cache-Control") != "no-store" {
+				t.Errorf("Cache-Control = %q, want no-store", recorder.Header().Get("Cache-Control"))
+			}
+			if _, err := png.Decode(recorder.Body); err != nil {
+				t.Errorf("ответ не PNG: %v", err)
+			}
+		})
+	}
+}
@@ -1,40 +1,129 @@
 package main
 
 import (
-	"context"
 	"crypto/rand"
 	"encoding/base32"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"log"
+	"math"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
-	"github.com/pquerna/otp/totp"
 )
 
 func authMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		sessionKey, err := c.Cookie(config.Sessions.CookieName)
+		// Чужой Bearer токен принадлежит upstream-приложению: пользователь входит по cookie,
+		// а заголовок уходит в upstream без изменений
+		if rawToken, ok := bearerToken(c.GetHeader("Authorization")); ok {
+			if _, _, isAPIToken := parseAPIToken(rawToken); isAPIToken {
+				authenticateBearer(c, rawToken)
+				return
+			}
+		}
+
+		sessionID, err := c.Cookie(config.Sessions.CookieName)
 		if err != nil {
 			redirectToAuth(c)
 			return
 		}
 
-		ctx := context.Background()
-		username, err := valkeyClient.Do(ctx, valkeyClient.B().Get().Key(sessionKey).Build()).ToString()
-		if err != nil {
+		session, err := GetSession(sessionID)
+		if err != nil || session.Evicted() {
+			redirectToAuth(c)
+			return
+		}
+
+		// Сессия удаленного пользователя недействительна, даже если ее TTL еще не истек
+		exists, err := UserExists(session.Username)
+		if err == nil && !exists {
+			DeleteSession(sessionID)
+		}
+		if err != nil || !exists {
+			redirectToAuth(c)
+			return
+		}
+
+		// Запрос с другой подсети или браузера не продлевает сессию
+		if session.BindMode != "" && session.BindMode != sessionBindingOff &&
+			!sessionBindingMatches(session, c.ClientIP(), c.Request.UserAgent()) {
+			log.Printf("Отпечаток клиента не совпадает с сессией пользователя %s: IP %s", session.Username, c.ClientIP())
+			if session.BindMode == sessionBindingReject {
+				rejectSessionBinding(c)
+				return
+			}
+			DeleteSession(sessionID)
+			redirectToAuth(c)
+			return
+		}
+
+		// Сессия, достигшая предельного срока, завершается независимо от активности
+		if !TouchSession(session) {
+			DeleteSession(sessionID)
 			redirectToAuth(c)
 			return
 		}
 
-		valkeyClient.Do(ctx, valkeyClient.B().Expire().Key(sessionKey).Seconds(int64(config.Sessions.TTLSeconds)).Build())
-		c.Set("username", username)
+		c.Set("username", session.Username)
 		c.Next()
 	}
 }
 
+// bearerToken извлекает токен из заголовка "Authorization: Bearer <токен>"
+func bearerToken(header string) (string, bool) {
+	scheme, token, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// authenticateBearer проверяет API токен. Машинным клиентам при ошибке отвечаем 401, а не редиректом.
+func authenticateBearer(c *gin.Context, rawToken string) {
+	token, err := AuthenticateAPIToken(rawToken)
+	if err == nil {
+		var exists bool
+		exists, err = UserExists(token.Username)
+		if err == nil && !exists {
+			err = fmt.Errorf("пользователь %s удален", token.Username)
+		}
+	}
+	if err != nil {
+		log.Printf("Отклонен API токен с IP %s: %v", c.ClientIP(), err)
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"detail": "Недействительный API токен"})
+		return
+	}
+
+	// Токен предназначен прокси и не должен уходить в upstream
+	c.Request.Header.Del("Authorization")
+
+	c.Set("username", token.Username)
+	c.Set("apiTokenID", token.ID)
+	if len(token.Scopes) > 0 {
+		c.Set("apiTokenScopes", token.Scopes)
+	}
+	c.Next()
+}
+
+// rejectSessionBinding отклоняет запрос, отпечаток которого не совпадает с сессией
+func rejectSessionBinding(c *gin.Context) {
+	if isAPIRequest(c, c.Request.URL.Path) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"detail": "Сессия привязана к другому устройству или сети. Выполните вход заново.",
+		})
+		return
+	}
+	c.String(http.StatusForbidden, "Сессия привязана к другому устройству или сети. Выполните вход заново.")
+	c.Abort()
+}
+
 func redirectToAuth(c *gin.Context) {
 	// Формируем полный URL запроса с учетом схемы и порта
 	requestURL := c.Request.URL
@@ -59,43 +148,120 @@ func handleLogin(c *gin.Context) {
 	username := c.PostForm("username")
 	totpCode := c.PostForm("totp")
 	redirectUrl := c.PostForm("redirectUrl")
+	clientIP := c.ClientIP()
+
+	if !validateCSRF(c) {
+		renderLoginPage(c, http.StatusForbidden, gin.H{
+			"error":       "форма устарела, попробуйте войти еще раз",
+			"redirectUrl": redirectUrl,
+		})
+		return
+	}
+
+	// Проверяем блокировку до проверки кода, чтобы не давать перебирать коды во время нее
+	throttle := CheckLoginThrottle(username, clientIP)
+	if throttle.Locked || throttle.RetryAfter > 0 {
+		renderLoginThrottled(c, throttle, redirectUrl)
+		return
+	}
 
 	// Получаем пользователя из Valkey
 	user, err := GetUser(username)
 	if err != nil {
-		c.HTML(http.StatusOK, "login.html", gin.H{
+		RegisterLoginFailure(username, clientIP)
+		renderLoginPage(c, http.StatusOK, gin.H{
 			"error":       "нет имени",
 			"redirectUrl": redirectUrl,
 		})
 		return
 	}
 
-	if !totp.Validate(totpCode, user.TOTPSecret) {
-		c.HTML(http.StatusOK, "login.html", gin.H{
+	valid, replayed, err := ValidateUserTOTP(username, totpCode, user.TOTPSecret)
+	if err != nil {
+		log.Printf("Ошибка проверки ОТП пользователя %s: %v", username, err)
+	}
+	if replayed {
+		RegisterLoginFailure(username, clientIP)
+		renderLoginPage(c, http.StatusOK, gin.H{
+			"error":       "этот ОТП уже использован, дождитесь следующего кода",
+			"redirectUrl": redirectUrl,
+		})
+		return
+	}
+	if !valid {
+		RegisterLoginFailure(username, clientIP)
+		renderLoginPage(c, http.StatusOK, gin.H{
 			"error":       "неправильный ОТП",
 			"redirectUrl": redirectUrl,
 		})
 		return
 	}
 
-	sessionKey := generateSessionKey()
-	ctx := context.Background()
-	valkeyClient.Do(ctx, valkeyClient.B().Set().Key(sessionKey).Value(username).ExSeconds(int64(config.Sessions.TTLSeconds)).Build())
+	ResetLoginFailures(username)
+
+	err = EnforceSessionLimit(username, user.Roles)
+	if errors.Is(err, ErrSessionLimitReached) {
+		renderLoginPage(c, http.StatusForbidden, gin.H{
+			"error":       "достигнут лимит одновременных сессий: выйдите на другом устройстве или обратитесь к администратору",
+			"redirectUrl": redirectUrl,
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Ошибка проверки лимита сессий пользователя %s: %v", username, err)
+	}
+
+	sessionID, err := CreateSession(c, username, loginMethodTOTP, getSessionBinding(user.Roles))
+	if err != nil {
+		log.Printf("Ошибка создания сессии пользователя %s: %v", username, err)
+		renderLoginPage(c, http.StatusInternalServerError, gin.H{
+			"error":       "не удалось создать сессию, попробуйте еще раз",
+			"redirectUrl": redirectUrl,
+		})
+		return
+	}
 
+	c.SetSameSite(getSessionSameSite())
 	c.SetCookie(
 		config.Sessions.CookieName,
-		sessionKey,
-		config.Sessions.TTLSeconds,
+		sessionID,
+		int(ttlSeconds(getSessionAbsoluteTimeout())),
 		"/",
 		config.Sessions.CookieDomain,
 		true,
 		true,
 	)
 
+	if err := issueAdminSession(c, username); err != nil {
+		log.Printf("Не удалось выдать админ-сессию пользователю %s: %v", username, err)
+	}
+
 	if redirectUrl == "" {
 		redirectUrl = resolveDefaultRedirectFromValkey(user, username)
 	}
-	c.Redirect(http.StatusFound, redirectUrl)
+	c.Redirect(http.StatusFound, safeRedirectURL(redirectUrl))
+}
+
+// renderLoginPage показывает страницу входа с CSRF токеном для формы
+func renderLoginPage(c *gin.Context, status int, data gin.H) {
+	data["csrfToken"] = ensureCSRFToken(c)
+	c.HTML(status, "login.html", data)
+}
+
+// renderLoginThrottled показывает страницу входа с сообщением о блокировке или задержке
+func renderLoginThrottled(c *gin.Context, throttle LoginThrottle, redirectUrl string) {
+	retryAfterSeconds := int(math.Ceil(throttle.RetryAfter.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(retryAfterSeconds))
+
+	message := fmt.Sprintf("Слишком частые попытки входа. Повторите через %d сек.", retryAfterSeconds)
+	if throttle.Locked {
+		message = fmt.Sprintf("Слишком много неудачных попыток. Вход временно заблокирован, повторите через %d мин.", int(math.Ceil(throttle.RetryAfter.Minutes())))
+	}
+
+	renderLoginPage(c, http.StatusTooManyRequests, gin.H{
+		"lockout":     message,
+		"redirectUrl": redirectUrl,
+	})
 }
 
 func generateSessionKey() string {
@@ -124,7 +290,13 @@ func resolveDefaultRedirectFromValkey(user *ValkeyUser, username string) string
 		return fmt.Sprintf("https://%s:%d/", fallbackHost, port)
 	}
 
-	candidate := strings.TrimSpace(permissions[0])
+	candidate := ""
+	for _, perm := range permissions {
+		if !isAdminPermission(perm) {
+			candidate = strings.TrimSpace(perm)
+			break
+		}
+	}
 	if candidate == "" {
 		if fallbackHost == "" {
 			return fmt.Sprintf("https://%s:%d/", defaultHost, port)
@@ -133,7 +305,7 @@ func resolveDefaultRedirectFromValkey(user *ValkeyUser, username string) string
 	}
 
 	if strings.Contains(candidate, "://") {
-		return candidate
+		return safeRedirectURL(candidate)
 	}
 
 	if strings.HasPrefix(candidate, "/") {
@@ -162,18 +334,19 @@ func resolveDefaultRedirectFromValkey(user *ValkeyUser, username string) string
 }
 
 func defaultUpstreamHost() string {
-	if config == nil || len(config.Upstreams) == 0 {
+	upstreams := getUpstreamConfigs()
+	if len(upstreams) == 0 {
 		return ""
 	}
-	return config.Upstreams[0].Host
+	return upstreams[0].Host
 }
 
 func getDefaultProxyHost() string {
 	if config != nil && config.Proxy.DefaultHost != "" {
 		return config.Proxy.DefaultHost
 	}
-	if config != nil && len(config.Upstreams) > 0 {
-		return config.Upstreams[0].Host
+	if upstreams := getUpstreamConfigs(); len(upstreams) > 0 {
+		return upstreams[0].Host
 	}
 	return "rest.secure-proxy.lan"
 }
@@ -186,12 +359,22 @@ func getProxyPort() int {
 }
 
 func handleLogout(c *gin.Context) {
-	sessionKey, err := c.Cookie(config.Sessions.CookieName)
-	if err == nil && sessionKey != "" {
-		ctx := context.Background()
-		valkeyClient.Do(ctx, valkeyClient.B().Del().Key(sessionKey).Build())
+	sessionID, err := c.Cookie(config.Sessions.CookieName)
+	if err == nil && sessionID != "" {
+		if err := DeleteSession(sessionID); err != nil {
+			log.Printf("Ошибка удаления сессии: %v", err)
+		}
+	}
+
+	// Админ-сессия выдается отдельно, без выхода из нее /admin и /api оставались бы открыты
+	adminSessionKey, err := c.Cookie(getAdminCookieName())
+	if err == nil && adminSessionKey != "" {
+		if err := deleteAdminSession(adminSessionKey); err != nil {
+			log.Printf("Ошибка удаления админ-сессии: %v", err)
+		}
 	}
 
+	c.SetSameSite(getSessionSameSite())
 	c.SetCookie(
 		config.Sessions.CookieName,
 		"",
@@ -201,6 +384,7 @@ func handleLogout(c *gin.Context) {
 		true,
 		true,
 	)
+	c.SetCookie(getAdminCookieName(), "", -1, "/", "", true, true)
 
 	c.Redirect(http.StatusFound, "https://auth.secure-proxy.lan:8443/")
 }
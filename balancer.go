@@ -0,0 +1,252 @@
+// Package main - балансировка нагрузки между адресами upstream.
+// Поддерживает стратегии round_robin, least_connections и weighted, ведет статистику
+// по каждому адресу и временно исключает адрес после серии ошибок (пассивная проверка).
+package main
+
+import (
+	"net/url"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Стратегии балансировки
+const (
+	balanceRoundRobin       = "round_robin"
+	balanceLeastConnections = "least_connections"
+	balanceWeighted         = "weighted"
+)
+
+const (
+	defaultDestinationMaxFails     = 3
+	defaultDestinationEjectSeconds = 30
+)
+
+func isValidBalanceStrategy(strategy string) bool {
+	switch strategy {
+	case "", balanceRoundRobin, balanceLeastConnections, balanceWeighted:
+		return true
+	}
+	return false
+}
+
+// destination - один адрес upstream со счетчиками и состоянием исключения
+type destination struct {
+	url    *url.URL
+	weight int
+
+	active   atomic.Int64
+	requests atomic.Uint64
+	failures atomic.Uint64
+
+	mu                  sync.Mutex
+	consecutiveFailures int
+	ejectedUntil        time.Time
+	lastError           string
+	lastFailure         time.Time
+
+	// Результаты активных проверок, защищены mu
+	health destinationHealth
+
+	// Текущий вес плавного взвешенного round-robin, защищен мьютексом балансировщика
+	currentWeight int
+}
+
+// DestinationStats - статистика адреса upstream для API управления
+type DestinationStats struct {
+	URL                 string     `json:"url"`
+	Weight              int        `json:"weight"`
+	ActiveRequests      int64      `json:"activeRequests"`
+	Requests            uint64     `json:"requests"`
+	Failures            uint64     `json:"failures"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	Ejected             bool       `json:"ejected"`
+	EjectedUntil        *time.Time `json:"ejectedUntil,omitempty"`
+	LastError           string     `json:"lastError,omitempty"`
+	LastFailure         *time.Time `json:"lastFailure,omitempty"`
+
+	// Health заполнен, если для upstream включены активные проверки
+	Health *HealthStatus `json:"health,omitempty"`
+}
+
+// isEjected сообщает, исключен ли адрес из ротации в момент now
+func (d *destination) isEjected(now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return now.Before(d.ejectedUntil)
+}
+
+// isAvailable сообщает, находится ли адрес в ротации: не исключен после ошибок и прошел активные проверки
+func (d *destination) isAvailable(now time.Time) bool {
+	return !d.isEjected(now) && d.isHealthy()
+}
+
+// recordSuccess сбрасывает серию ошибок
+func (d *destination) recordSuccess() {
+	d.mu.Lock()
+	d.consecutiveFailures = 0
+	d.mu.Unlock()
+}
+
+// recordFailure учитывает ошибку и после maxFails ошибок подряд исключает адрес на ejectFor.
+// Возвращает true, если адрес был исключен этой ошибкой.
+func (d *destination) recordFailure(reason string, now time.Time, maxFails int, ejectFor time.Duration) bool {
+	d.failures.Add(1)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.consecutiveFailures++
+	d.lastError = reason
+	d.lastFailure = now
+	if d.consecutiveFailures >= maxFails && !now.Before(d.ejectedUntil) {
+		d.ejectedUntil = now.Add(ejectFor)
+		return true
+	}
+	return false
+}
+
+func (d *destination) stats(now time.Time) DestinationStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	stats := DestinationStats{
+		URL:                 d.url.String(),
+		Weight:              d.weight,
+		ActiveRequests:      d.active.Load(),
+		Requests:            d.requests.Load(),
+		Failures:            d.failures.Load(),
+		ConsecutiveFailures: d.consecutiveFailures,
+		LastError:           d.lastError,
+		Health:              d.health.healthStatus(),
+	}
+	if now.Before(d.ejectedUntil) {
+		ejectedUntil := d.ejectedUntil
+		stats.Ejected = true
+		stats.EjectedUntil = &ejectedUntil
+	}
+	if !d.lastFailure.IsZero() {
+		lastFailure := d.lastFailure
+		stats.LastFailure = &lastFailure
+	}
+	return stats
+}
+
+// loadBalancer выбирает адрес upstream для очередного запроса
+type loadBalancer struct {
+	strategy     string
+	destinations []*destination
+	maxFails     int
+	ejectFor     time.Duration
+
+	counter  atomic.Uint64
+	weightMu sync.Mutex
+}
+
+func newLoadBalancer(destinations []*destination, cfg LoadBalancingConfig) *loadBalancer {
+	strategy := cfg.Strategy
+	if strategy == "" {
+		strategy = balanceRoundRobin
+	}
+	return &loadBalancer{
+		strategy:     strategy,
+		destinations: destinations,
+		maxFails:     intOrDefault(cfg.MaxFails, defaultDestinationMaxFails),
+		ejectFor:     secondsOrDefault(cfg.EjectSeconds, defaultDestinationEjectSeconds),
+	}
+}
+
+// available возвращает адреса в ротации. Если исключены все, возвращаются все:
+// лучше попробовать сбойный адрес, чем отказать без попытки.
+func (lb *loadBalancer) available(now time.Time) []*destination {
+	available := make([]*destination, 0, len(lb.destinations))
+	for _, d := range lb.destinations {
+		if d.isAvailable(now) {
+			available = append(available, d)
+		}
+	}
+	if len(available) == 0 {
+		return lb.destinations
+	}
+	return available
+}
+
+// pick выбирает адрес по стратегии балансировки
+func (lb *loadBalancer) pick(now time.Time) *destination {
+	if len(lb.destinations) == 1 {
+		return lb.destinations[0]
+	}
+	return lb.pickFrom(lb.available(now))
+}
+
+// pickExcept выбирает адрес для повтора, пропуская уже испробованные.
+// Если других адресов нет, повтор идет на любой доступный.
+func (lb *loadBalancer) pickExcept(now time.Time, tried []*destination) *destination {
+	if len(tried) == 0 || len(lb.destinations) == 1 {
+		return lb.pick(now)
+	}
+
+	available := lb.available(now)
+	candidates := make([]*destination, 0, len(available))
+	for _, d := range available {
+		if !slices.Contains(tried, d) {
+			candidates = append(candidates, d)
+		}
+	}
+	if len(candidates) == 0 {
+		return lb.pickFrom(available)
+	}
+	return lb.pickFrom(candidates)
+}
+
+func (lb *loadBalancer) pickFrom(candidates []*destination) *destination {
+	switch lb.strategy {
+	case balanceLeastConnections:
+		return lb.pickLeastConnections(candidates)
+	case balanceWeighted:
+		return lb.pickWeighted(candidates)
+	default:
+		return candidates[lb.counter.Add(1)%uint64(len(candidates))]
+	}
+}
+
+// pickLeastConnections выбирает адрес с наименьшим числом активных запросов.
+// Перебор начинается со сдвига, чтобы при равенстве нагрузка распределялась по кругу.
+func (lb *loadBalancer) pickLeastConnections(candidates []*destination) *destination {
+	offset := int(lb.counter.Add(1) % uint64(len(candidates)))
+	best := candidates[offset]
+	for i := 1; i < len(candidates); i++ {
+		candidate := candidates[(offset+i)%len(candidates)]
+		if candidate.active.Load() < best.active.Load() {
+			best = candidate
+		}
+	}
+	return best
+}
+
+// pickWeighted - плавный взвешенный round-robin (как в nginx): адреса чередуются
+// пропорционально весам без серий подряд на самый тяжелый адрес
+func (lb *loadBalancer) pickWeighted(candidates []*destination) *destination {
+	lb.weightMu.Lock()
+	defer lb.weightMu.Unlock()
+
+	total := 0
+	var best *destination
+	for _, d := range candidates {
+		d.currentWeight += d.weight
+		total += d.weight
+		if best == nil || d.currentWeight > best.currentWeight {
+			best = d
+		}
+	}
+	best.currentWeight -= total
+	return best
+}
+
+func (lb *loadBalancer) stats(now time.Time) []DestinationStats {
+	stats := make([]DestinationStats, 0, len(lb.destinations))
+	for _, d := range lb.destinations {
+		stats = append(stats, d.stats(now))
+	}
+	return stats
+}
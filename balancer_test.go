@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func newTestDestinations(t *testing.T, weights ...int) []*destination {
+	t.Helper()
+	destinations := make([]*destination, 0, len(weights))
+	for i, weight := range weights {
+		target, err := url.Parse("http://backend-" + string(rune('a'+i)) + ":8000")
+		if err != nil {
+			t.Fatal(err)
+		}
+		destinations = append(destinations, &destination{url: target, weight: weight})
+	}
+	return destinations
+}
+
+// countPicks выбирает адрес n раз и считает выборы по хосту
+func countPicks(lb *loadBalancer, n int, now time.Time) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		counts[lb.pick(now).url.Host]++
+	}
+	return counts
+}
+
+func TestLoadBalancerRoundRobin(t *testing.T) {
+	lb := newLoadBalancer(newTestDestinations(t, 1, 1, 1), LoadBalancingConfig{})
+	counts := countPicks(lb, 300, time.Now())
+
+	for host, count := range counts {
+		if count != 100 {
+			t.Errorf("%s выбран %d раз, want 100", host, count)
+		}
+	}
+}
+
+func TestLoadBalancerWeighted(t *testing.T) {
+	lb := newLoadBalancer(newTestDestinations(t, 1, 3), LoadBalancingConfig{Strategy: balanceWeighted})
+	counts := countPicks(lb, 400, time.Now())
+
+	if counts["backend-a:8000"] != 100 || counts["backend-b:8000"] != 300 {
+		t.Errorf("распределение %v, want 100/300", counts)
+	}
+}
+
+func TestLoadBalancerLeastConnections(t *testing.T) {
+	destinations := newTestDestinations(t, 1, 1, 1)
+	destinations[0].active.Store(5)
+	destinations[1].active.Store(1)
+	destinations[2].active.Store(3)
+	lb := newLoadBalancer(destinations, LoadBalancingConfig{Strategy: balanceLeastConnections})
+
+	for i := 0; i < 5; i++ {
+		if got := lb.pick(time.Now()); got != destinations[1] {
+			t.Fatalf("выбран %s, want адрес с наименьшей нагрузкой", got.url.Host)
+		}
+	}
+}
+
+func TestLoadBalancerEjection(t *testing.T) {
+	destinations := newTestDestinations(t, 1, 1)
+	lb := newLoadBalancer(destinations, LoadBalancingConfig{MaxFails: 2, EjectSeconds: 10})
+	now := time.Now()
+
+	if destinations[0].recordFailure("HTTP 502", now, lb.maxFails, lb.ejectFor) {
+		t.Fatal("адрес исключен после первой ошибки")
+	}
+	if !destinations[0].recordFailure("HTTP 502", now, lb.maxFails, lb.ejectFor) {
+		t.Fatal("адрес не исключен после maxFails ошибок")
+	}
+
+	counts := countPicks(lb, 10, now.Add(time.Second))
+	if counts["backend-a:8000"] != 0 {
+		t.Errorf("исключенный адрес выбран %d раз", counts["backend-a:8000"])
+	}
+
+	// После срока исключения адрес возвращается в ротацию
+	counts = countPicks(lb, 10, now.Add(11*time.Second))
+	if counts["backend-a:8000"] == 0 {
+		t.Error("адрес не вернулся в ротацию после срока исключения")
+	}
+
+	// Если исключены все адреса, балансировщик все равно выбирает из всех
+	destinations[1].recordFailure("HTTP 502", now, 1, lb.ejectFor)
+	if got := lb.pick(now.Add(time.Second)); got == nil {
+		t.Error("нет адреса, когда исключены все")
+	}
+
+	destinations[0].recordSuccess()
+	if stats := destinations[0].stats(now); stats.ConsecutiveFailures != 0 || stats.Failures != 2 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestDestinationConfigYAML(t *testing.T) {
+	var upstream UpstreamConfig
+	data := `
+host: rest.secure-proxy.lan
+destinations:
+    - http://backend-1:8000
+    - url: http://backend-2:8000
+      weight: 3
+`
+	if err := yaml.Unmarshal([]byte(data), &upstream); err != nil {
+		t.Fatalf("yaml.Unmarshal() error = %v", err)
+	}
+
+	want := []DestinationConfig{{URL: "http://backend-1:8000"}, {URL: "http://backend-2:8000", Weight: 3}}
+	if len(upstream.Destinations) != len(want) {
+		t.Fatalf("destinations = %+v", upstream.Destinations)
+	}
+	for i := range want {
+		if upstream.Destinations[i] != want[i] {
+			t.Errorf("destinations[%d] = %+v, want %+v", i, upstream.Destinations[i], want[i])
+		}
+	}
+}
+
+func TestDestinationConfigs(t *testing.T) {
+	if configs, err := destinationConfigs(UpstreamConfig{Destination: "http://backend:8000"}); err != nil || len(configs) != 1 {
+		t.Errorf("одиночный destination: %+v, %v", configs, err)
+	}
+	if _, err := destinationConfigs(UpstreamConfig{}); err == nil {
+		t.Error("ожидалась ошибка без адресов")
+	}
+	both := UpstreamConfig{Destination: "http://a", Destinations: []DestinationConfig{{URL: "http://b"}}}
+	if _, err := destinationConfigs(both); err == nil {
+		t.Error("ожидалась ошибка при destination и destinations одновременно")
+	}
+}
+
+func TestLoadBalancerPickExcept(t *testing.T) {
+	destinations := newTestDestinations(t, 1, 1, 1)
+	lb := newLoadBalancer(destinations, LoadBalancingConfig{})
+	now := time.Now()
+
+	for i := 0; i < 6; i++ {
+		if got := lb.pickExcept(now, destinations[:2]); got != destinations[2] {
+			t.Fatalf("выбран %s, want единственный неиспробованный адрес", got.url.Host)
+		}
+	}
+
+	// Если испробованы все, повтор идет на любой адрес
+	if got := lb.pickExcept(now, destinations); got == nil {
+		t.Error("нет адреса, когда испробованы все")
+	}
+}
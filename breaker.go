@@ -0,0 +1,128 @@
+// Package main - автоматический выключатель (circuit breaker) upstream.
+// После серии сбоев подряд выключатель размыкается и запросы сразу получают 503,
+// не нагружая упавший сервис; после паузы пропускается один пробный запрос.
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Состояния выключателя
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half_open"
+)
+
+const (
+	defaultCircuitFailureThreshold = 5
+	defaultCircuitCooldownSeconds  = 30
+)
+
+// CircuitStats - состояние выключателя для API управления
+type CircuitStats struct {
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	OpenedAt            *time.Time `json:"openedAt,omitempty"`
+}
+
+// circuitBreaker считает сбои upstream подряд по всем его адресам
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	// В полуоткрытом состоянии пропускается только один пробный запрос
+	probing bool
+}
+
+func newCircuitBreaker(cfg CircuitBreakerConfig) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: intOrDefault(cfg.FailureThreshold, defaultCircuitFailureThreshold),
+		cooldown:  secondsOrDefault(cfg.CooldownSeconds, defaultCircuitCooldownSeconds),
+		state:     circuitClosed,
+	}
+}
+
+// allow сообщает, можно ли отправить запрос в момент now, и является ли он пробным.
+// Если нельзя, возвращает время до следующей пробной попытки.
+func (b *circuitBreaker) allow(now time.Time) (allowed, probe bool, retryAfter time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		retryAt := b.openedAt.Add(b.cooldown)
+		if now.Before(retryAt) {
+			return false, false, retryAt.Sub(now)
+		}
+		b.state = circuitHalfOpen
+		b.probing = true
+		return true, true, 0
+	case circuitHalfOpen:
+		if b.probing {
+			return false, false, b.cooldown
+		}
+		b.probing = true
+		return true, true, 0
+	}
+	return true, false, 0
+}
+
+// recordSuccess замыкает выключатель. Возвращает true, если он был разомкнут.
+func (b *circuitBreaker) recordSuccess() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	recovered := b.state != circuitClosed
+	b.state = circuitClosed
+	b.failures = 0
+	b.probing = false
+	return recovered
+}
+
+// recordFailure учитывает сбой. Возвращает true, если выключатель разомкнулся.
+// Неудачный пробный запрос сразу размыкает выключатель на новую паузу.
+func (b *circuitBreaker) recordFailure(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	switch b.state {
+	case circuitHalfOpen:
+		b.state = circuitOpen
+		b.openedAt = now
+		b.probing = false
+		return true
+	case circuitClosed:
+		if b.failures >= b.threshold {
+			b.state = circuitOpen
+			b.openedAt = now
+			return true
+		}
+	}
+	return false
+}
+
+// abandon освобождает место пробного запроса, результат которого неизвестен (клиент отключился)
+func (b *circuitBreaker) abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+func (b *circuitBreaker) stats() CircuitStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats := CircuitStats{State: b.state, ConsecutiveFailures: b.failures}
+	if b.state != circuitClosed {
+		openedAt := b.openedAt
+		stats.OpenedAt = &openedAt
+	}
+	return stats
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	breaker := newCircuitBreaker(CircuitBreakerConfig{FailureThreshold: 2, CooldownSeconds: 30})
+	now := time.Now()
+
+	if breaker.recordFailure(now) {
+		t.Fatal("выключатель разомкнут после 1 сбоя, порог 2")
+	}
+	if !breaker.recordFailure(now) {
+		t.Fatal("выключатель должен разомкнуться после 2 сбоев")
+	}
+
+	allowed, _, retryAfter := breaker.allow(now.Add(10 * time.Second))
+	if allowed || retryAfter != 20*time.Second {
+		t.Fatalf("allow() = %v, %v; want запрет на 20s", allowed, retryAfter)
+	}
+
+	// После паузы пропускается ровно один пробный запрос
+	allowed, probe, _ := breaker.allow(now.Add(30 * time.Second))
+	if !allowed || !probe {
+		t.Fatal("после паузы должен пройти пробный запрос")
+	}
+	if allowed, _, _ := breaker.allow(now.Add(30 * time.Second)); allowed {
+		t.Fatal("второй запрос во время пробного должен быть отклонен")
+	}
+
+	// Неудачный пробный запрос размыкает выключатель на новую паузу
+	if !breaker.recordFailure(now.Add(31 * time.Second)) {
+		t.Fatal("неудачный пробный запрос должен разомкнуть выключатель")
+	}
+	if allowed, _, _ := breaker.allow(now.Add(40 * time.Second)); allowed {
+		t.Fatal("выключатель должен оставаться разомкнутым до конца новой паузы")
+	}
+
+	// Отключившийся клиент освобождает место пробного запроса
+	if allowed, _, _ := breaker.allow(now.Add(61 * time.Second)); !allowed {
+		t.Fatal("после новой паузы должен пройти пробный запрос")
+	}
+	breaker.abandon()
+	if allowed, probe, _ := breaker.allow(now.Add(61 * time.Second)); !allowed || !probe {
+		t.Fatal("после отмены пробного запроса должен пройти новый")
+	}
+
+	if !breaker.recordSuccess() || breaker.stats().State != circuitClosed {
+		t.Fatal("успешный пробный запрос должен замкнуть выключатель")
+	}
+	if allowed, probe, _ := breaker.allow(now.Add(62 * time.Second)); !allowed || probe {
+		t.Fatal("замкнутый выключатель пропускает запросы без проб")
+	}
+}
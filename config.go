@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"os"
 
 	"github.com/ilyakaznacheev/cleanenv"
@@ -8,21 +9,115 @@ import (
 )
 
 type Config struct {
-	Proxy      ProxyConfig      `yaml:"proxy"`
-	Sessions   SessionsConfig   `yaml:"sessions"`
-	Users      []UserConfig     `yaml:"users"`
-	Upstreams  []UpstreamConfig `yaml:"upstreams"`
+	Proxy     ProxyConfig      `yaml:"proxy"`
+	Sessions  SessionsConfig   `yaml:"sessions"`
+	Users     []UserConfig     `yaml:"users"`
+	Upstreams []UpstreamConfig `yaml:"upstreams"`
+	Admin     AdminConfig      `yaml:"admin"`
+	Access    AccessConfig     `yaml:"access"`
+	Security  SecurityConfig   `yaml:"security"`
 }
 
+// ProxyConfig описывает прокси сервер.
+// TrustedProxies - адреса и CIDR балансировщиков перед secure-proxy, чьим X-Forwarded-For
+// можно верить при определении IP клиента. Пустой список - не доверять никому.
 type ProxyConfig struct {
-	DefaultHost string `yaml:"defaultHost"`
-	Port        int    `yaml:"port"`
+	DefaultHost    string   `yaml:"defaultHost"`
+	Port           int      `yaml:"port"`
+	TrustedProxies []string `yaml:"trustedProxies"`
 }
 
+// SessionsConfig описывает сессии пользователей.
+// IdleTimeoutSeconds - время жизни сессии без активности, продлевается каждым запросом.
+// AbsoluteTimeoutSeconds - предельное время жизни сессии с момента входа, не продлевается.
+// TTLSeconds - прежнее название IdleTimeoutSeconds, используется, если новое не задано.
+// SameSite - атрибут cookie сессий: "lax" (по умолчанию), "strict" или "none".
 type SessionsConfig struct {
-	CookieDomain string `yaml:"cookieDomain"`
-	CookieName   string `yaml:"cookieName"`
-	TTLSeconds   int    `yaml:"ttlSeconds"`
+	CookieDomain           string               `yaml:"cookieDomain"`
+	CookieName             string               `yaml:"cookieName"`
+	TTLSeconds             int                  `yaml:"ttlSeconds"`
+	IdleTimeoutSeconds     int                  `yaml:"idleTimeoutSeconds"`
+	AbsoluteTimeoutSeconds int                  `yaml:"absoluteTimeoutSeconds"`
+	SameSite               string               `yaml:"sameSite"`
+	Limits                 SessionLimitConfig   `yaml:"limits"`
+	Binding                SessionBindingConfig `yaml:"binding"`
+}
+
+// SessionLimitConfig ограничивает число одновременных сессий пользователя.
+// MaxPerUser = 0 - без ограничения. RoleOverrides задает лимит для ролей: если у пользователя
+// несколько ролей с лимитом, действует наибольший из них.
+// Policy при достижении лимита: "evict_oldest" (по умолчанию) завершает самые старые сессии,
+// "reject" отклоняет новый вход.
+type SessionLimitConfig struct {
+	MaxPerUser    int            `yaml:"maxPerUser"`
+	RoleOverrides map[string]int `yaml:"roleOverrides"`
+	Policy        string         `yaml:"policy"`
+}
+
+// SessionBindingConfig описывает привязку сессии к отпечатку клиента.
+// Общая политика задается на верхнем уровне, Roles переопределяет ее для ролей:
+// если у пользователя несколько ролей со своей политикой, действует самая мягкая.
+type SessionBindingConfig struct {
+	SessionBindingPolicy `yaml:",inline"`
+	Roles                map[string]SessionBindingPolicy `yaml:"roles"`
+}
+
+// SessionBindingPolicy - политика привязки сессии.
+// Mode: "off" (по умолчанию) - без проверки, "reauth" - при смене отпечатка сессия завершается
+// и требуется повторный вход, "reject" - запрос с чужого отпечатка отклоняется, сессия сохраняется.
+// IPv4PrefixLength/IPv6PrefixLength - размер подсети, в пределах которой IP может меняться (24/64).
+// UserAgent - сверять ли также User-Agent.
+type SessionBindingPolicy struct {
+	Mode             string `yaml:"mode"`
+	IPv4PrefixLength int    `yaml:"ipv4PrefixLength"`
+	IPv6PrefixLength int    `yaml:"ipv6PrefixLength"`
+	UserAgent        bool   `yaml:"userAgent"`
+}
+
+// AdminConfig описывает доступ к админ-панели и API управления
+type AdminConfig struct {
+	Permission string `yaml:"permission"`
+	CookieName string `yaml:"cookieName"`
+}
+
+// AccessConfig описывает политику доступа к upstream ресурсам.
+// DefaultPolicy применяется, когда у пользователя нет прав или их не удалось получить:
+// "deny" (по умолчанию, рекомендуется для production) или "allow".
+type AccessConfig struct {
+	DefaultPolicy string `yaml:"defaultPolicy"`
+}
+
+type SecurityConfig struct {
+	Login     LoginProtectionConfig `yaml:"login"`
+	TOTP      TOTPConfig            `yaml:"totp"`
+	APITokens APITokensConfig       `yaml:"apiTokens"`
+}
+
+// APITokensConfig ограничивает срок действия персональных API токенов
+type APITokensConfig struct {
+	MaxLifetimeDays int `yaml:"maxLifetimeDays"`
+}
+
+// TOTPConfig описывает параметры проверки TOTP кодов и otpauth ссылок для приложений.
+// Skew - допустимое число периодов до и после текущего (nil - значение по умолчанию).
+// AccountLabel - метка учетной записи в приложении, {username} заменяется именем пользователя.
+type TOTPConfig struct {
+	Period       int    `yaml:"period"`
+	Skew         *int   `yaml:"skew"`
+	Digits       int    `yaml:"digits"`
+	Issuer       string `yaml:"issuer"`
+	AccountLabel string `yaml:"accountLabel"`
+}
+
+// LoginProtectionConfig описывает защиту входа от перебора TOTP кодов.
+// Нулевые значения заменяются значениями по умолчанию из lockout.go.
+type LoginProtectionConfig struct {
+	MaxFailuresPerUser   int `yaml:"maxFailuresPerUser"`
+	MaxFailuresPerIP     int `yaml:"maxFailuresPerIP"`
+	FailureWindowSeconds int `yaml:"failureWindowSeconds"`
+	LockoutSeconds       int `yaml:"lockoutSeconds"`
+	BackoffBaseSeconds   int `yaml:"backoffBaseSeconds"`
+	BackoffMaxSeconds    int `yaml:"backoffMaxSeconds"`
 }
 
 type UserConfig struct {
@@ -31,9 +126,150 @@ type UserConfig struct {
 	AllowedPaths []string `yaml:"allowedPaths"`
 }
 
+// UpstreamConfig описывает upstream сервер.
+// Destination - единственный адрес (прежняя форма), Destinations - несколько адресов с балансировкой.
 type UpstreamConfig struct {
-	Host        string `yaml:"host"`
-	Destination string `yaml:"destination"`
+	Host           string                  `yaml:"host"`
+	Destination    string                  `yaml:"destination"`
+	Destinations   []DestinationConfig     `yaml:"destinations"`
+	LoadBalancing  LoadBalancingConfig     `yaml:"loadBalancing"`
+	HealthCheck    HealthCheckConfig       `yaml:"healthCheck"`
+	CircuitBreaker CircuitBreakerConfig    `yaml:"circuitBreaker"`
+	Retry          RetryConfig             `yaml:"retry"`
+	Identity       UpstreamIdentityConfig  `yaml:"identity"`
+	Headers        UpstreamHeadersConfig   `yaml:"headers"`
+	Rewrite        UpstreamRewriteConfig   `yaml:"rewrite"`
+	Transport      UpstreamTransportConfig `yaml:"transport"`
+
+	// Общий таймаут запроса к upstream до получения заголовков ответа вместе с повторами (60;
+	// передачу тела ответа и WebSocket не ограничивает) и предельный размер тела запроса
+	// (10 МБ, -1 - без ограничения). Таймауты соединения и заголовков ответа - в transport.
+	RequestTimeoutSeconds int   `yaml:"requestTimeoutSeconds"`
+	MaxRequestBodyBytes   int64 `yaml:"maxRequestBodyBytes"`
+}
+
+// UpstreamTransportConfig - параметры соединений с upstream, 0 - значение по умолчанию.
+// MaxIdleConns/MaxIdleConnsPerHost - размер пула keep-alive соединений (100/32),
+// MaxConnsPerHost - предел одновременных соединений (без предела),
+// IdleConnTimeoutSeconds - время жизни простаивающего соединения (90),
+// DialTimeoutSeconds - таймаут установки соединения (5), KeepAliveSeconds - TCP keep-alive (30),
+// TLSHandshakeTimeoutSeconds (10), ResponseHeaderTimeoutSeconds - ожидание заголовков ответа (30).
+// HTTP2 - пробовать HTTP/2 для https destination (по умолчанию да).
+type UpstreamTransportConfig struct {
+	MaxIdleConns                 int   `yaml:"maxIdleConns"`
+	MaxIdleConnsPerHost          int   `yaml:"maxIdleConnsPerHost"`
+	MaxConnsPerHost              int   `yaml:"maxConnsPerHost"`
+	IdleConnTimeoutSeconds       int   `yaml:"idleConnTimeoutSeconds"`
+	DialTimeoutSeconds           int   `yaml:"dialTimeoutSeconds"`
+	KeepAliveSeconds             int   `yaml:"keepAliveSeconds"`
+	TLSHandshakeTimeoutSeconds   int   `yaml:"tlsHandshakeTimeoutSeconds"`
+	ResponseHeaderTimeoutSeconds int   `yaml:"responseHeaderTimeoutSeconds"`
+	HTTP2                        *bool `yaml:"http2"`
+}
+
+// UpstreamHeadersConfig - политика заголовков запросов к upstream.
+// Drop дополняет встроенный список удаляемых заголовков (Forwarded, X-Client-IP и т.п.),
+// Set задает заголовки, которые всегда перезаписываются значением из конфигурации.
+type UpstreamHeadersConfig struct {
+	Drop []string          `yaml:"drop"`
+	Set  map[string]string `yaml:"set"`
+}
+
+// UpstreamRewriteConfig - преобразование пути запроса к upstream. По порядку: StripPrefix удаляет
+// префикс пути клиента, Regex - первая подходящая замена ($1 и т.п. в Replacement), AddPrefix добавляет
+// префикс, затем путь присоединяется к базовому пути destination. В ответе Location и Path cookie
+// переводятся обратно (только префиксы, замены по выражениям не отменяются).
+type UpstreamRewriteConfig struct {
+	StripPrefix string               `yaml:"stripPrefix"`
+	AddPrefix   string               `yaml:"addPrefix"`
+	Regex       []RegexRewriteConfig `yaml:"regex"`
+}
+
+// RegexRewriteConfig - замена пути по регулярному выражению
+type RegexRewriteConfig struct {
+	Pattern     string `yaml:"pattern"`
+	Replacement string `yaml:"replacement"`
+}
+
+// DestinationConfig - адрес upstream. В YAML задается строкой или объектом {url, weight}.
+// Weight учитывается стратегией weighted, по умолчанию 1.
+type DestinationConfig struct {
+	URL    string `yaml:"url"`
+	Weight int    `yaml:"weight"`
+}
+
+// UnmarshalYAML позволяет записывать адрес без веса просто строкой
+func (d *DestinationConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		d.URL = value.Value
+		return nil
+	}
+	type plain DestinationConfig
+	return value.Decode((*plain)(d))
+}
+
+// LoadBalancingConfig описывает балансировку между адресами upstream.
+// Strategy: "round_robin" (по умолчанию), "least_connections" или "weighted".
+// После MaxFails ошибок подряд (3) адрес исключается из ротации на EjectSeconds (30).
+type LoadBalancingConfig struct {
+	Strategy     string `yaml:"strategy"`
+	MaxFails     int    `yaml:"maxFails"`
+	EjectSeconds int    `yaml:"ejectSeconds"`
+}
+
+// CircuitBreakerConfig описывает выключатель upstream: после FailureThreshold сбоев подряд (5)
+// запросы сразу получают 503, через CooldownSeconds (30) пропускается пробный запрос.
+type CircuitBreakerConfig struct {
+	FailureThreshold int `yaml:"failureThreshold"`
+	CooldownSeconds  int `yaml:"cooldownSeconds"`
+}
+
+// RetryConfig описывает повторы безопасных запросов (GET, HEAD, OPTIONS и запросов с Idempotency-Key)
+// после ошибки соединения или ответа 502/503/504. Attempts - число повторов, 0 - повторы выключены.
+// Пауза перед повтором растет от BackoffMilliseconds (50) вдвое до MaxBackoffMilliseconds (1000).
+// Повторы за 10 секунд не превышают BudgetPercent (20) процентов запросов плюс BudgetMinRetries (10).
+type RetryConfig struct {
+	Attempts               int `yaml:"attempts"`
+	BackoffMilliseconds    int `yaml:"backoffMilliseconds"`
+	MaxBackoffMilliseconds int `yaml:"maxBackoffMilliseconds"`
+	BudgetPercent          int `yaml:"budgetPercent"`
+	BudgetMinRetries       int `yaml:"budgetMinRetries"`
+}
+
+// HealthCheckConfig описывает активные проверки адресов upstream. Пустой Path - проверки выключены.
+// IntervalSeconds - период проверок (10), TimeoutSeconds - таймаут запроса (2),
+// ExpectedStatus - ожидаемый статус ответа (по умолчанию любой 2xx).
+// Адрес выводится из ротации после UnhealthyThreshold неудачных проверок подряд (3)
+// и возвращается после HealthyThreshold успешных (2).
+type HealthCheckConfig struct {
+	Path               string `yaml:"path"`
+	IntervalSeconds    int    `yaml:"intervalSeconds"`
+	TimeoutSeconds     int    `yaml:"timeoutSeconds"`
+	ExpectedStatus     int    `yaml:"expectedStatus"`
+	HealthyThreshold   int    `yaml:"healthyThreshold"`
+	UnhealthyThreshold int    `yaml:"unhealthyThreshold"`
+}
+
+// UpstreamIdentityConfig описывает передачу личности пользователя в upstream.
+// Enabled включает заголовки X-Auth-User и X-Auth-Roles; клиентские копии удаляются всегда.
+type UpstreamIdentityConfig struct {
+	Enabled bool              `yaml:"enabled"`
+	JWT     IdentityJWTConfig `yaml:"jwt"`
+}
+
+// IdentityJWTConfig описывает подпись личности короткоживущим JWT.
+// Algorithm: "HS256" (Key - общий секрет) или "ES256" (Key - PEM ключ P-256); пустой - без JWT.
+// KeyFile читается вместо Key, чтобы не хранить ключ в config.yaml.
+// Header - заголовок с токеном (X-Auth-Token), Audience по умолчанию равен хосту upstream.
+type IdentityJWTConfig struct {
+	Algorithm  string `yaml:"algorithm"`
+	Key        string `yaml:"key"`
+	KeyFile    string `yaml:"keyFile"`
+	KeyID      string `yaml:"keyId"`
+	Header     string `yaml:"header"`
+	TTLSeconds int    `yaml:"ttlSeconds"`
+	Issuer     string `yaml:"issuer"`
+	Audience   string `yaml:"audience"`
 }
 
 func ReadConfig() (*Config, error) {
@@ -48,6 +284,43 @@ func ReadConfig() (*Config, error) {
 		return nil, err
 	}
 
+	switch config.Access.DefaultPolicy {
+	case "", accessPolicyDeny, accessPolicyAllow:
+	default:
+		return nil, fmt.Errorf("неизвестная политика доступа access.defaultPolicy: %q", config.Access.DefaultPolicy)
+	}
+
+	switch config.Sessions.Limits.Policy {
+	case "", sessionLimitEvictOldest, sessionLimitReject:
+	default:
+		return nil, fmt.Errorf("неизвестная политика sessions.limits.policy: %q", config.Sessions.Limits.Policy)
+	}
+
+	if !isValidSameSite(config.Sessions.SameSite) {
+		return nil, fmt.Errorf("неизвестное значение sessions.sameSite: %q", config.Sessions.SameSite)
+	}
+
+	if !isValidSessionBindingMode(config.Sessions.Binding.Mode) {
+		return nil, fmt.Errorf("неизвестный режим sessions.binding.mode: %q", config.Sessions.Binding.Mode)
+	}
+	for role, policy := range config.Sessions.Binding.Roles {
+		if !isValidSessionBindingMode(policy.Mode) {
+			return nil, fmt.Errorf("неизвестный режим sessions.binding.roles.%s.mode: %q", role, policy.Mode)
+		}
+	}
+
+	for _, upstream := range config.Upstreams {
+		if !isValidBalanceStrategy(upstream.LoadBalancing.Strategy) {
+			return nil, fmt.Errorf("upstream %s: неизвестная стратегия loadBalancing.strategy: %q", upstream.Host, upstream.LoadBalancing.Strategy)
+		}
+	}
+
+	switch config.Security.TOTP.Digits {
+	case 0, 6, 8:
+	default:
+		return nil, fmt.Errorf("security.totp.digits должно быть 6 или 8, указано %d", config.Security.TOTP.Digits)
+	}
+
 	return config, nil
 }
 
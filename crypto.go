@@ -0,0 +1,195 @@
+// Package main - шифрование TOTP секретов в Valkey.
+// Использует envelope шифрование: секрет шифруется случайным ключом данных (AES-256-GCM),
+// а ключ данных - мастер-ключом из переменной окружения или файла ключей.
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// EncryptedSecret - зашифрованный секрет вместе с идентификатором мастер-ключа
+type EncryptedSecret struct {
+	KeyID      string `json:"kid"`
+	WrappedKey string `json:"wrappedKey"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+// TOTPKeyring - набор мастер-ключей. Первый ключ активный, остальные нужны для расшифровки старых записей.
+type TOTPKeyring struct {
+	activeID string
+	keys     map[string][]byte
+}
+
+// totpKeyring равен nil, если ключи не настроены: тогда секреты хранятся открытым текстом
+var totpKeyring *TOTPKeyring
+
+// LoadTOTPKeyring загружает мастер-ключи из TOTP_KEYS ("id:base64,id:base64")
+// или из файла TOTP_KEYS_FILE (по одному "id:base64" на строку). Первый ключ - активный.
+func LoadTOTPKeyring() (*TOTPKeyring, error) {
+	if keys := os.Getenv("TOTP_KEYS"); keys != "" {
+		return parseTOTPKeyring(strings.Split(keys, ","))
+	}
+
+	keysFile := os.Getenv("TOTP_KEYS_FILE")
+	if keysFile == "" {
+		return nil, nil
+	}
+
+	file, err := os.Open(keysFile)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения файла ключей: %v", err)
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка чтения файла ключей: %v", err)
+	}
+
+	return parseTOTPKeyring(lines)
+}
+
+func parseTOTPKeyring(entries []string) (*TOTPKeyring, error) {
+	keyring := &TOTPKeyring{keys: make(map[string][]byte)}
+
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("неверный формат ключа, ожидается id:base64")
+		}
+
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("ключ %s: ошибка декодирования base64: %v", parts[0], err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("ключ %s: ожидается 32 байта, получено %d", parts[0], len(key))
+		}
+		if _, exists := keyring.keys[parts[0]]; exists {
+			return nil, fmt.Errorf("ключ %s указан повторно", parts[0])
+		}
+
+		keyring.keys[parts[0]] = key
+		if keyring.activeID == "" {
+			keyring.activeID = parts[0]
+		}
+	}
+
+	if keyring.activeID == "" {
+		return nil, fmt.Errorf("не указано ни одного ключа")
+	}
+
+	return keyring, nil
+}
+
+// ActiveKeyID возвращает идентификатор ключа, которым шифруются новые записи
+func (k *TOTPKeyring) ActiveKeyID() string {
+	return k.activeID
+}
+
+// Encrypt шифрует секрет новым ключом данных. aad привязывает шифротекст к записи (имени пользователя).
+func (k *TOTPKeyring) Encrypt(plaintext, aad string) (*EncryptedSecret, error) {
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := sealAESGCM(dataKey, []byte(plaintext), []byte(aad))
+	if err != nil {
+		return nil, err
+	}
+
+	wrappedKey, err := sealAESGCM(k.keys[k.activeID], dataKey, []byte(k.activeID))
+	if err != nil {
+		return nil, err
+	}
+
+	return &EncryptedSecret{
+		KeyID:      k.activeID,
+		WrappedKey: base64.StdEncoding.EncodeToString(wrappedKey),
+		Ciphertext: base64.StdEncoding.EncodeToString(ciphertext),
+	}, nil
+}
+
+// Decrypt расшифровывает секрет любым известным ключом из набора
+func (k *TOTPKeyring) Decrypt(secret *EncryptedSecret, aad string) (string, error) {
+	masterKey, ok := k.keys[secret.KeyID]
+	if !ok {
+		return "", fmt.Errorf("неизвестный ключ шифрования: %s", secret.KeyID)
+	}
+
+	wrappedKey, err := base64.StdEncoding.DecodeString(secret.WrappedKey)
+	if err != nil {
+		return "", fmt.Errorf("ошибка декодирования ключа данных: %v", err)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(secret.Ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("ошибка декодирования шифротекста: %v", err)
+	}
+
+	dataKey, err := openAESGCM(masterKey, wrappedKey, []byte(secret.KeyID))
+	if err != nil {
+		return "", fmt.Errorf("ошибка расшифровки ключа данных: %v", err)
+	}
+
+	plaintext, err := openAESGCM(dataKey, ciphertext, []byte(aad))
+	if err != nil {
+		return "", fmt.Errorf("ошибка расшифровки секрета: %v", err)
+	}
+
+	return string(plaintext), nil
+}
+
+// sealAESGCM шифрует данные и возвращает nonce вместе с шифротекстом
+func sealAESGCM(key, plaintext, aad []byte) ([]byte, error) {
+	gcm, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func openAESGCM(key, sealed, aad []byte) ([]byte, error) {
+	gcm, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("слишком короткий шифротекст")
+	}
+
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, aad)
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func testKeyEntry(id string, fill byte) string {
+	return id + ":" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{fill}, 32))
+}
+
+func TestTOTPKeyringEncryptDecrypt(t *testing.T) {
+	keyring, err := parseTOTPKeyring([]string{testKeyEntry("k1", 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret := "VGLFTEMMJYNRCC36PNS6ZCURQPLYAXRY"
+	encrypted, err := keyring.Encrypt(secret, "user:sklad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encrypted.KeyID != "k1" {
+		t.Errorf("KeyID = %q, want %q", encrypted.KeyID, "k1")
+	}
+	if strings.Contains(encrypted.Ciphertext, secret) {
+		t.Error("шифротекст содержит секрет открытым текстом")
+	}
+
+	decrypted, err := keyring.Decrypt(encrypted, "user:sklad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted != secret {
+		t.Errorf("Decrypt() = %q, want %q", decrypted, secret)
+	}
+
+	// Шифротекст привязан к записи: подставить его другому пользователю нельзя
+	if _, err := keyring.Decrypt(encrypted, "user:admin"); err == nil {
+		t.Error("Decrypt() с чужим именем пользователя должен вернуть ошибку")
+	}
+}
+
+func TestTOTPKeyringRotation(t *testing.T) {
+	oldKeyring, err := parseTOTPKeyring([]string{testKeyEntry("k1", 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := oldKeyring.Encrypt("SECRET", "user:sklad")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// После ротации новый ключ активный, а старый остается для расшифровки
+	rotated, err := parseTOTPKeyring([]string{testKeyEntry("k2", 2), testKeyEntry("k1", 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.ActiveKeyID() != "k2" {
+		t.Errorf("ActiveKeyID() = %q, want %q", rotated.ActiveKeyID(), "k2")
+	}
+	if decrypted, err := rotated.Decrypt(encrypted, "user:sklad"); err != nil || decrypted != "SECRET" {
+		t.Errorf("Decrypt() = %q, %v, want %q", decrypted, err, "SECRET")
+	}
+
+	withoutOld, err := parseTOTPKeyring([]string{testKeyEntry("k2", 2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := withoutOld.Decrypt(encrypted, "user:sklad"); err == nil {
+		t.Error("Decrypt() без старого ключа должен вернуть ошибку")
+	}
+}
+
+func TestParseTOTPKeyringErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+	}{
+		{"пустой набор", []string{"", "# комментарий"}},
+		{"нет идентификатора", []string{":" + base64.StdEncoding.EncodeToString(make([]byte, 32))}},
+		{"неверный base64", []string{"k1:не-base64"}},
+		{"короткий ключ", []string{"k1:" + base64.StdEncoding.EncodeToString(make([]byte, 16))}},
+		{"повтор идентификатора", []string{testKeyEntry("k1", 1), testKeyEntry("k1", 2)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseTOTPKeyring(tt.entries); err == nil {
+				t.Error("parseTOTPKeyring() должен вернуть ошибку")
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+// Package main - защита от подделки межсайтовых запросов (CSRF).
+// Использует double-submit токен: значение из cookie должно совпасть со значением из формы
+// или заголовка X-CSRF-Token. Дополнительно изменяющие запросы проверяются по Origin/Referer.
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	csrfCookieName = "SECURE_PROXY_CSRF"
+	csrfHeaderName = "X-CSRF-Token"
+	csrfFormField  = "csrf_token"
+
+	// Длина токена: 32 случайных байта в hex, как у ключа сессии
+	csrfTokenLength = 64
+)
+
+// Значения sessions.sameSite
+const (
+	sameSiteLax    = "lax"
+	sameSiteStrict = "strict"
+	sameSiteNone   = "none"
+)
+
+func isValidSameSite(value string) bool {
+	switch strings.ToLower(value) {
+	case "", sameSiteLax, sameSiteStrict, sameSiteNone:
+		return true
+	}
+	return false
+}
+
+// getSessionSameSite возвращает атрибут SameSite для cookie сессий (по умолчанию Lax)
+func getSessionSameSite() http.SameSite {
+	if config != nil {
+		switch strings.ToLower(config.Sessions.SameSite) {
+		case sameSiteStrict:
+			return http.SameSiteStrictMode
+		case sameSiteNone:
+			return http.SameSiteNoneMode
+		}
+	}
+	return http.SameSiteLaxMode
+}
+
+// ensureCSRFToken возвращает CSRF токен клиента, при отсутствии выдает новый.
+// Cookie привязан к текущему хосту: каждая форма отправляется на тот же хост, с которого получена.
+func ensureCSRFToken(c *gin.Context) string {
+	token, err := c.Cookie(csrfCookieName)
+	if err == nil && len(token) == csrfTokenLength {
+		return token
+	}
+
+	token = generateSessionKey()
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(csrfCookieName, token, 0, "/", "", true, true)
+	return token
+}
+
+// csrfTokensMatch сравнивает токен из cookie с отправленным за постоянное время
+func csrfTokensMatch(cookieToken, submittedToken string) bool {
+	if len(cookieToken) != csrfTokenLength || len(submittedToken) != csrfTokenLength {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookieToken), []byte(submittedToken)) == 1
+}
+
+// isSameOriginRequest проверяет, что запрос отправлен со страницы того же хоста.
+// Используется Origin, а при его отсутствии - Referer. Если нет обоих заголовков, запрос
+// отправлен не браузером и проверка не применяется: от CSRF его защищает токен.
+func isSameOriginRequest(origin, referer, host string) bool {
+	source := origin
+	if source == "" {
+		source = referer
+	}
+	if source == "" {
+		return true
+	}
+
+	sourceURL, err := url.Parse(source)
+	if err != nil || sourceURL.Host == "" {
+		return false
+	}
+	return strings.EqualFold(sourceURL.Host, host)
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// validateCSRF проверяет изменяющий запрос: источник и совпадение токена из cookie и формы/заголовка
+func validateCSRF(c *gin.Context) bool {
+	if isSafeMethod(c.Request.Method) {
+		return true
+	}
+	if !isSameOriginRequest(c.GetHeader("Origin"), c.GetHeader("Referer"), c.Request.Host) {
+		return false
+	}
+
+	cookieToken, _ := c.Cookie(csrfCookieName)
+	submittedToken := c.GetHeader(csrfHeaderName)
+	if submittedToken == "" {
+		submittedToken = c.PostForm(csrfFormField)
+	}
+	return csrfTokensMatch(cookieToken, submittedToken)
+}
+
+// csrfMiddleware отклоняет изменяющие запросы без действительного CSRF токена
+func csrfMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if validateCSRF(c) {
+			c.Next()
+			return
+		}
+
+		if isAPIRequest(c, c.Request.URL.Path) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Недействительный CSRF токен, обновите страницу"})
+			return
+		}
+		c.String(http.StatusForbidden, "Недействительный CSRF токен, обновите страницу")
+		c.Abort()
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsSameOriginRequest(t *testing.T) {
+	host := "auth.secure-proxy.lan:8443"
+
+	tests := []struct {
+		name    string
+		origin  string
+		referer string
+		want    bool
+	}{
+		{"тот же Origin", "https://auth.secure-proxy.lan:8443", "", true},
+		{"Origin в другом регистре", "https://AUTH.secure-proxy.lan:8443", "", true},
+		{"чужой Origin", "https://evil.example", "", false},
+		{"другой порт", "https://auth.secure-proxy.lan", "", false},
+		{"Origin null", "null", "", false},
+		{"Referer того же хоста", "", "https://auth.secure-proxy.lan:8443/admin", true},
+		{"чужой Referer", "", "https://evil.example/page", false},
+		{"Origin важнее Referer", "https://evil.example", "https://auth.secure-proxy.lan:8443/", false},
+		{"нет заголовков", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isSameOriginRequest(tt.origin, tt.referer, host); got != tt.want {
+				t.Errorf("isSameOriginRequest(%q, %q) = %v, want %v", tt.origin, tt.referer, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCSRFTokensMatch(t *testing.T) {
+	token := strings.Repeat("a1", csrfTokenLength/2)
+	other := strings.Repeat("b2", csrfTokenLength/2)
+
+	tests := []struct {
+		name      string
+		cookie    string
+		submitted string
+		want      bool
+	}{
+		{"совпадают", token, token, true},
+		{"различаются", token, other, false},
+		{"нет cookie", "", token, false},
+		{"нет токена в запросе", token, "", false},
+		{"оба пустые", "", "", false},
+		{"короткий токен", "abc", "abc", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := csrfTokensMatch(tt.cookie, tt.submitted); got != tt.want {
+				t.Errorf("csrfTokensMatch() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
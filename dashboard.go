@@ -34,8 +34,9 @@ func handleDashboard(c *gin.Context) {
 	links := buildDashboardLinksFromPermissions(permissions, currentHost)
 
 	c.HTML(http.StatusOK, "dashboard.html", gin.H{
-		"Username": usernameStr,
-		"Links":    links,
+		"Username":  usernameStr,
+		"Links":     links,
+		"csrfToken": ensureCSRFToken(c),
 	})
 }
 
@@ -46,7 +47,7 @@ func buildDashboardLinksFromPermissions(permissions []string, currentHost string
 
 	for _, allowed := range permissions {
 		allowed = strings.TrimSpace(allowed)
-		if allowed == "" {
+		if allowed == "" || isAdminPermission(allowed) {
 			continue
 		}
 
@@ -93,4 +94,3 @@ func formatTitle(host, path string) string {
 	}
 	return host
 }
-
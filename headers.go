@@ -0,0 +1,120 @@
+// Package main - очистка заголовков запросов к upstream.
+// Удаляет заголовки, которыми клиент может выдать себя за другой адрес или хост,
+// задает обязательные заголовки upstream и определяет доверенные прокси перед secure-proxy.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultDroppedHeaders удаляются из запросов ко всем upstream: их значения задает только прокси
+var defaultDroppedHeaders = []string{
+	"Forwarded",
+	"X-Forwarded-Port",
+	"X-Forwarded-Server",
+	"X-Forwarded-Prefix",
+	"X-Original-URL",
+	"X-Rewrite-URL",
+	"X-Client-IP",
+	"X-Cluster-Client-IP",
+	"True-Client-IP",
+	"CF-Connecting-IP",
+}
+
+// trustedProxyPrefixes - сети прокси перед secure-proxy, которым разрешено передавать X-Forwarded-For
+var trustedProxyPrefixes []netip.Prefix
+
+// parseTrustedProxies разбирает список адресов и CIDR доверенных прокси
+func parseTrustedProxies(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("неверная сеть доверенного прокси %q: %v", entry, err)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("неверный адрес доверенного прокси %q: %v", entry, err)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+func getTrustedProxies() []string {
+	if config == nil {
+		return nil
+	}
+	return config.Proxy.TrustedProxies
+}
+
+// LoadTrustedProxies разбирает список доверенных прокси из конфигурации
+func LoadTrustedProxies() error {
+	prefixes, err := parseTrustedProxies(getTrustedProxies())
+	if err != nil {
+		return err
+	}
+	trustedProxyPrefixes = prefixes
+	return nil
+}
+
+// applyTrustedProxies настраивает определение IP клиента в gin.
+// Без списка gin доверяет X-Forwarded-For от любого клиента, поэтому пустой список означает
+// "не доверять никому": ClientIP равен адресу TCP соединения.
+func applyTrustedProxies(engine *gin.Engine) error {
+	return engine.SetTrustedProxies(getTrustedProxies())
+}
+
+// isTrustedProxy проверяет, входит ли адрес в сети доверенных прокси
+func isTrustedProxy(ip string, prefixes []netip.Prefix) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeUpstreamHeaders удаляет заголовки, которым upstream не должен доверять.
+// httputil.ReverseProxy дописывает адрес соединения к X-Forwarded-For, поэтому цепочку клиента
+// сохраняем только от доверенного прокси, иначе upstream получит лишь адрес соединения.
+func sanitizeUpstreamHeaders(header http.Header, remoteIP string, upstream *UpstreamConfig, trusted []netip.Prefix) {
+	for _, name := range defaultDroppedHeaders {
+		header.Del(name)
+	}
+	if upstream != nil {
+		for _, name := range upstream.Headers.Drop {
+			header.Del(name)
+		}
+	}
+
+	if !isTrustedProxy(remoteIP, trusted) {
+		header.Del("X-Forwarded-For")
+	}
+}
+
+// forceUpstreamHeaders задает заголовки из настроек upstream поверх любых других значений
+func forceUpstreamHeaders(header http.Header, upstream *UpstreamConfig) {
+	if upstream == nil {
+		return
+	}
+	for name, value := range upstream.Headers.Set {
+		header.Set(name, value)
+	}
+}
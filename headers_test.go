@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	prefixes, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.10", "fd00::/8"})
+	if err != nil {
+		t.Fatalf("parseTrustedProxies() error = %v", err)
+	}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.20.30.40", true},
+		{"192.168.1.10", true},
+		{"192.168.1.11", false},
+		{"::ffff:10.0.0.1", true},
+		{"fd12::1", true},
+		{"203.0.113.5", false},
+		{"not-an-ip", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := isTrustedProxy(tt.ip, prefixes); got != tt.want {
+				t.Errorf("isTrustedProxy(%q) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+
+	for _, entry := range []string{"10.0.0.0/33", "proxy.lan"} {
+		if _, err := parseTrustedProxies([]string{entry}); err == nil {
+			t.Errorf("parseTrustedProxies(%q): ожидалась ошибка", entry)
+		}
+	}
+}
+
+func TestSanitizeUpstreamHeaders(t *testing.T) {
+	trusted, _ := parseTrustedProxies([]string{"10.0.0.0/8"})
+	upstream := &UpstreamConfig{Headers: UpstreamHeadersConfig{
+		Drop: []string{"X-Debug-User"},
+		Set:  map[string]string{"X-Served-By": "secure-proxy"},
+	}}
+
+	newHeader := func() http.Header {
+		header := http.Header{}
+		header.Set("X-Forwarded-For", "1.2.3.4")
+		header.Set("Forwarded", "for=1.2.3.4")
+		header.Set("True-Client-IP", "1.2.3.4")
+		header.Set("X-Debug-User", "admin")
+		header.Set("X-Served-By", "client")
+		header.Set("Accept", "application/json")
+		return header
+	}
+
+	t.Run("клиент напрямую", func(t *testing.T) {
+		header := newHeader()
+		sanitizeUpstreamHeaders(header, "203.0.113.5", upstream, trusted)
+		forceUpstreamHeaders(header, upstream)
+
+		for _, name := range []string{"X-Forwarded-For", "Forwarded", "True-Client-IP", "X-Debug-User"} {
+			if value := header.Get(name); value != "" {
+				t.Errorf("заголовок %s = %q, ожидалось удаление", name, value)
+			}
+		}
+		if got := header.Get("X-Served-By"); got != "secure-proxy" {
+			t.Errorf("X-Served-By = %q, want secure-proxy", got)
+		}
+		if got := header.Get("Accept"); got != "application/json" {
+			t.Errorf("Accept = %q, обычные заголовки должны сохраняться", got)
+		}
+	})
+
+	t.Run("через доверенный прокси", func(t *testing.T) {
+		header := newHeader()
+		sanitizeUpstreamHeaders(header, "10.1.2.3", upstream, trusted)
+		if got := header.Get("X-Forwarded-For"); got != "1.2.3.4" {
+			t.Errorf("X-Forwarded-For = %q, цепочка доверенного прокси должна сохраняться", got)
+		}
+		if got := header.Get("Forwarded"); got != "" {
+			t.Errorf("Forwarded = %q, ожидалось удаление", got)
+		}
+	})
+}
@@ -0,0 +1,242 @@
+// Package main - активные проверки доступности адресов upstream.
+// Каждый адрес периодически опрашивается HTTP запросом; после серии неудачных проверок
+// адрес выводится из ротации, после серии успешных - возвращается.
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHealthCheckIntervalSeconds = 10
+	defaultHealthCheckTimeoutSeconds  = 2
+	defaultHealthyThreshold           = 2
+	defaultUnhealthyThreshold         = 3
+
+	// Сколько байт тела ответа проверки дочитывается, чтобы соединение вернулось в пул
+	healthCheckBodyLimit = 64 << 10
+)
+
+// HealthStatus - результат активных проверок адреса для API управления
+type HealthStatus struct {
+	Healthy              bool       `json:"healthy"`
+	LastCheck            *time.Time `json:"lastCheck,omitempty"`
+	LastStatus           int        `json:"lastStatus,omitempty"`
+	LastError            string     `json:"lastError,omitempty"`
+	LatencyMs            int64      `json:"latencyMs"`
+	ConsecutiveSuccesses int        `json:"consecutiveSuccesses"`
+	ConsecutiveFailures  int        `json:"consecutiveFailures"`
+}
+
+// destinationHealth - состояние активных проверок адреса, защищено мьютексом адреса
+type destinationHealth struct {
+	enabled   bool
+	unhealthy bool
+	successes int
+	failures  int
+	lastCheck time.Time
+	status    int
+	lastError string
+	latency   time.Duration
+}
+
+// healthCheckSettings - настройки проверок с подставленными значениями по умолчанию
+type healthCheckSettings struct {
+	path               *url.URL
+	interval           time.Duration
+	timeout            time.Duration
+	expectedStatus     int
+	healthyThreshold   int
+	unhealthyThreshold int
+}
+
+func newHealthCheckSettings(cfg HealthCheckConfig) (*healthCheckSettings, error) {
+	if cfg.Path == "" {
+		return nil, nil
+	}
+	path, err := url.Parse(cfg.Path)
+	if err != nil || path.IsAbs() || path.Host != "" {
+		return nil, fmt.Errorf("healthCheck.path должен быть путем, указано %q", cfg.Path)
+	}
+
+	return &healthCheckSettings{
+		path:               path,
+		interval:           secondsOrDefault(cfg.IntervalSeconds, defaultHealthCheckIntervalSeconds),
+		timeout:            secondsOrDefault(cfg.TimeoutSeconds, defaultHealthCheckTimeoutSeconds),
+		expectedStatus:     cfg.ExpectedStatus,
+		healthyThreshold:   intOrDefault(cfg.HealthyThreshold, defaultHealthyThreshold),
+		unhealthyThreshold: intOrDefault(cfg.UnhealthyThreshold, defaultUnhealthyThreshold),
+	}, nil
+}
+
+// healthCheckFailure проверяет результат запроса: пустая строка - проверка пройдена.
+// Без expectedStatus успешным считается любой статус 2xx.
+func healthCheckFailure(status int, err error, expectedStatus int) string {
+	if err != nil {
+		return err.Error()
+	}
+	if expectedStatus != 0 {
+		if status != expectedStatus {
+			return fmt.Sprintf("статус %d, ожидался %d", status, expectedStatus)
+		}
+		return ""
+	}
+	if status < 200 || status > 299 {
+		return fmt.Sprintf("статус %d", status)
+	}
+	return ""
+}
+
+// isHealthy сообщает, прошел ли адрес активные проверки. Без проверок адрес считается здоровым.
+func (d *destination) isHealthy() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return !d.health.unhealthy
+}
+
+// recordHealthCheck учитывает результат проверки с порогами переключения состояния.
+// Возвращает true, если состояние адреса изменилось.
+func (d *destination) recordHealthCheck(failure string, status int, latency time.Duration, now time.Time, settings *healthCheckSettings) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	health := &d.health
+	health.lastCheck = now
+	health.status = status
+	health.lastError = failure
+	health.latency = latency
+
+	if failure == "" {
+		health.successes++
+		health.failures = 0
+		if health.unhealthy && health.successes >= settings.healthyThreshold {
+			health.unhealthy = false
+			return true
+		}
+		return false
+	}
+
+	health.failures++
+	health.successes = 0
+	if !health.unhealthy && health.failures >= settings.unhealthyThreshold {
+		health.unhealthy = true
+		return true
+	}
+	return false
+}
+
+// healthStatus возвращает результат проверок; вызывается под мьютексом адреса
+func (h *destinationHealth) healthStatus() *HealthStatus {
+	if !h.enabled {
+		return nil
+	}
+	status := &HealthStatus{
+		Healthy:              !h.unhealthy,
+		LastStatus:           h.status,
+		LastError:            h.lastError,
+		LatencyMs:            h.latency.Milliseconds(),
+		ConsecutiveSuccesses: h.successes,
+		ConsecutiveFailures:  h.failures,
+	}
+	if !h.lastCheck.IsZero() {
+		lastCheck := h.lastCheck
+		status.LastCheck = &lastCheck
+	}
+	return status
+}
+
+// healthChecker периодически проверяет все адреса одного upstream
+type healthChecker struct {
+	upstream *upstreamProxy
+	settings *healthCheckSettings
+	client   *http.Client
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newHealthChecker(upstream *upstreamProxy, settings *healthCheckSettings) *healthChecker {
+	return &healthChecker{
+		upstream: upstream,
+		settings: settings,
+		client: &http.Client{
+			Transport: upstream.transport,
+			Timeout:   settings.timeout,
+			// Редирект - тоже ответ адреса, следовать за ним не нужно
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		stop: make(chan struct{}),
+	}
+}
+
+// start запускает проверки: первая сразу, затем с заданным интервалом
+func (h *healthChecker) start() {
+	go func() {
+		ticker := time.NewTicker(h.settings.interval)
+		defer ticker.Stop()
+
+		for {
+			h.checkAll()
+			select {
+			case <-ticker.C:
+			case <-h.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (h *healthChecker) shutdown() {
+	h.stopOnce.Do(func() { close(h.stop) })
+}
+
+// checkAll проверяет адреса параллельно, чтобы один зависший адрес не задерживал остальные
+func (h *healthChecker) checkAll() {
+	var wg sync.WaitGroup
+	for _, d := range h.upstream.balancer.destinations {
+		wg.Add(1)
+		go func(d *destination) {
+			defer wg.Done()
+			h.check(d)
+		}(d)
+	}
+	wg.Wait()
+}
+
+func (h *healthChecker) check(d *destination) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.settings.timeout)
+	defer cancel()
+
+	var status int
+	started := time.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.url.ResolveReference(h.settings.path).String(), nil)
+	if err == nil {
+		req.Host = h.upstream.config.Host
+		req.Header.Set("User-Agent", "secure-proxy-health-check")
+
+		var resp *http.Response
+		resp, err = h.client.Do(req)
+		if err == nil {
+			status = resp.StatusCode
+			io.Copy(io.Discard, io.LimitReader(resp.Body, healthCheckBodyLimit))
+			resp.Body.Close()
+		}
+	}
+
+	failure := healthCheckFailure(status, err, h.settings.expectedStatus)
+	if d.recordHealthCheck(failure, status, time.Since(started), time.Now(), h.settings) {
+		if failure == "" {
+			log.Printf("Адрес %s upstream %s снова доступен", d.url.Host, h.upstream.config.Host)
+		} else {
+			log.Printf("Адрес %s upstream %s выведен из ротации: %s", d.url.Host, h.upstream.config.Host, failure)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthCheckFailure(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		err      error
+		expected int
+		wantOK   bool
+	}{
+		{"2xx без ожидаемого статуса", http.StatusNoContent, nil, 0, true},
+		{"редирект без ожидаемого статуса", http.StatusFound, nil, 0, false},
+		{"ошибка сервера", http.StatusServiceUnavailable, nil, 0, false},
+		{"совпадает с ожидаемым", http.StatusFound, nil, http.StatusFound, true},
+		{"не совпадает с ожидаемым", http.StatusOK, nil, http.StatusNoContent, false},
+		{"ошибка соединения", 0, errors.New("connection refused"), 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			failure := healthCheckFailure(tt.status, tt.err, tt.expected)
+			if (failure == "") != tt.wantOK {
+				t.Errorf("healthCheckFailure() = %q, wantOK %v", failure, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestRecordHealthCheckThresholds(t *testing.T) {
+	settings := &healthCheckSettings{healthyThreshold: 2, unhealthyThreshold: 3}
+	d := newTestDestinations(t, 1)[0]
+	now := time.Now()
+
+	// Двух неудач мало, третья выводит адрес из ротации
+	for i := 0; i < 2; i++ {
+		if d.recordHealthCheck("статус 503", 503, 0, now, settings) || !d.isHealthy() {
+			t.Fatalf("адрес выведен после %d неудач, порог 3", i+1)
+		}
+	}
+	if !d.recordHealthCheck("статус 503", 503, 0, now, settings) || d.isHealthy() {
+		t.Fatal("адрес должен быть выведен после 3 неудач")
+	}
+
+	// Успех сбрасывает серию, но возвращает адрес только со второго раза
+	if d.recordHealthCheck("", 200, 0, now, settings) || d.isHealthy() {
+		t.Fatal("адрес возвращен после 1 успеха, порог 2")
+	}
+	if !d.recordHealthCheck("", 200, 0, now, settings) || !d.isHealthy() {
+		t.Fatal("адрес должен вернуться после 2 успехов")
+	}
+}
+
+func TestLoadBalancerSkipsUnhealthyDestination(t *testing.T) {
+	destinations := newTestDestinations(t, 1, 1)
+	destinations[0].health.unhealthy = true
+	lb := newLoadBalancer(destinations, LoadBalancingConfig{})
+
+	counts := countPicks(lb, 10, time.Now())
+	if counts["backend-b:8000"] != 10 {
+		t.Errorf("распределение %v, want все запросы на backend-b", counts)
+	}
+}
+
+func TestHealthCheckerCheck(t *testing.T) {
+	var gotPath, gotHost string
+	healthy := true
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotHost = r.URL.Path, r.Host
+		if !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer backend.Close()
+
+	upstream, err := newUpstreamProxy(UpstreamConfig{
+		Host:        "rest.secure-proxy.lan",
+		Destination: backend.URL,
+		HealthCheck: HealthCheckConfig{Path: "/health", UnhealthyThreshold: 1, HealthyThreshold: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checker := newHealthChecker(upstream, upstream.healthCheck)
+	d := upstream.balancer.destinations[0]
+
+	healthy = false
+	checker.checkAll()
+	if d.isHealthy() {
+		t.Error("адрес с ответом 503 должен быть выведен из ротации")
+	}
+	if gotPath != "/health" || gotHost != "rest.secure-proxy.lan" {
+		t.Errorf("проверка запросила %s%s, want rest.secure-proxy.lan/health", gotHost, gotPath)
+	}
+
+	healthy = true
+	checker.checkAll()
+	stats := upstream.balancer.stats(time.Now())
+	if stats[0].Health == nil || !stats[0].Health.Healthy || stats[0].Health.LastStatus != http.StatusOK {
+		t.Errorf("Health = %+v, want доступен со статусом 200", stats[0].Health)
+	}
+}
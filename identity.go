@@ -0,0 +1,242 @@
+// Package main - передача личности пользователя в upstream.
+// Прокси добавляет заголовки X-Auth-User и X-Auth-Roles, удаляя присланные клиентом копии,
+// и при необходимости подписывает их короткоживущим JWT (HS256 или ES256).
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	identityUserHeader  = "X-Auth-User"
+	identityRolesHeader = "X-Auth-Roles"
+
+	defaultIdentityTokenHeader     = "X-Auth-Token"
+	defaultIdentityTokenTTLSeconds = 60
+	defaultIdentityIssuer          = "secure-proxy"
+
+	// Минимальная длина ключа HS256: не короче выхода SHA-256
+	minIdentityHMACKeyLength = 32
+)
+
+// Алгоритмы подписи JWT
+const (
+	jwtAlgorithmHS256 = "HS256"
+	jwtAlgorithmES256 = "ES256"
+)
+
+// identitySigner подписывает личность пользователя для одного upstream
+type identitySigner struct {
+	algorithm string
+	keyID     string
+	header    string
+	issuer    string
+	audience  string
+	ttl       time.Duration
+	hmacKey   []byte
+	ecdsaKey  *ecdsa.PrivateKey
+}
+
+// identityClaims - содержимое JWT с личностью пользователя
+type identityClaims struct {
+	Issuer   string   `json:"iss"`
+	Audience string   `json:"aud"`
+	Subject  string   `json:"sub"`
+	Roles    []string `json:"roles"`
+	IssuedAt int64    `json:"iat"`
+	Expires  int64    `json:"exp"`
+}
+
+func newIdentitySigner(upstream UpstreamConfig) (*identitySigner, error) {
+	jwtConfig := upstream.Identity.JWT
+	signer := &identitySigner{
+		algorithm: jwtConfig.Algorithm,
+		keyID:     jwtConfig.KeyID,
+		header:    jwtConfig.Header,
+		issuer:    jwtConfig.Issuer,
+		audience:  jwtConfig.Audience,
+		ttl:       time.Duration(jwtConfig.TTLSeconds) * time.Second,
+	}
+	if signer.header == "" {
+		signer.header = defaultIdentityTokenHeader
+	}
+	if signer.issuer == "" {
+		signer.issuer = defaultIdentityIssuer
+	}
+	if signer.audience == "" {
+		signer.audience = upstream.Host
+	}
+	if signer.ttl <= 0 {
+		signer.ttl = defaultIdentityTokenTTLSeconds * time.Second
+	}
+
+	key := []byte(jwtConfig.Key)
+	if jwtConfig.KeyFile != "" {
+		var err error
+		key, err = os.ReadFile(jwtConfig.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка чтения ключа подписи: %v", err)
+		}
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("не задан ключ подписи identity.jwt.key или identity.jwt.keyFile")
+	}
+
+	switch signer.algorithm {
+	case jwtAlgorithmHS256:
+		key = []byte(strings.TrimSpace(string(key)))
+		if len(key) < minIdentityHMACKeyLength {
+			return nil, fmt.Errorf("ключ HS256 должен быть не короче %d байт", minIdentityHMACKeyLength)
+		}
+		signer.hmacKey = key
+	case jwtAlgorithmES256:
+		ecdsaKey, err := parseECDSAPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		signer.ecdsaKey = ecdsaKey
+	default:
+		return nil, fmt.Errorf("неподдерживаемый алгоритм подписи: %q", signer.algorithm)
+	}
+
+	return signer, nil
+}
+
+// parseECDSAPrivateKey разбирает PEM ключ P-256 в формате SEC 1 или PKCS #8
+func parseECDSAPrivateKey(pemData []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, fmt.Errorf("ключ ES256 должен быть в формате PEM")
+	}
+
+	var ecdsaKey *ecdsa.PrivateKey
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка разбора ключа ES256: %v", err)
+		}
+		ecdsaKey = key
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка разбора ключа ES256: %v", err)
+		}
+		var ok bool
+		if ecdsaKey, ok = key.(*ecdsa.PrivateKey); !ok {
+			return nil, fmt.Errorf("ключ ES256 должен быть ключом ECDSA")
+		}
+	default:
+		return nil, fmt.Errorf("неподдерживаемый тип PEM блока: %s", block.Type)
+	}
+
+	if ecdsaKey.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("ключ ES256 должен использовать кривую P-256")
+	}
+	return ecdsaKey, nil
+}
+
+// Sign выпускает JWT с личностью пользователя
+func (s *identitySigner) Sign(username string, roles []string, now time.Time) (string, error) {
+	header := map[string]string{"alg": s.algorithm, "typ": "JWT"}
+	if s.keyID != "" {
+		header["kid"] = s.keyID
+	}
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+
+	claimsJSON, err := json.Marshal(identityClaims{
+		Issuer:   s.issuer,
+		Audience: s.audience,
+		Subject:  username,
+		Roles:    roles,
+		IssuedAt: now.Unix(),
+		Expires:  now.Add(s.ttl).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	signature, err := s.signature([]byte(signingInput))
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func (s *identitySigner) signature(signingInput []byte) ([]byte, error) {
+	if s.algorithm == jwtAlgorithmHS256 {
+		mac := hmac.New(sha256.New, s.hmacKey)
+		mac.Write(signingInput)
+		return mac.Sum(nil), nil
+	}
+
+	// ES256 по RFC 7518: r и s фиксированной длины по 32 байта подряд, а не DER
+	digest := sha256.Sum256(signingInput)
+	r, sigS, err := ecdsa.Sign(rand.Reader, s.ecdsaKey, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	sigS.FillBytes(signature[32:])
+	return signature, nil
+}
+
+// stripIdentityHeaders удаляет заголовки личности, присланные клиентом
+func stripIdentityHeaders(header http.Header, tokenHeaders []string) {
+	header.Del(identityUserHeader)
+	header.Del(identityRolesHeader)
+	header.Del(defaultIdentityTokenHeader)
+	for _, tokenHeader := range tokenHeaders {
+		header.Del(tokenHeader)
+	}
+}
+
+// applyIdentityHeaders заменяет заголовки личности в запросе к upstream.
+// Для публичных маршрутов (username пустой) и upstream без identity.enabled заголовки только удаляются.
+func applyIdentityHeaders(req *http.Request, upstream *upstreamProxy, username string) {
+	stripIdentityHeaders(req.Header, upstream.identityHeaders)
+	if username == "" || !upstream.config.Identity.Enabled {
+		return
+	}
+
+	roles, err := GetUserRoles(username)
+	if err != nil {
+		log.Printf("Ошибка получения ролей для заголовков личности %s: %v", username, err)
+		roles = nil
+	}
+	sort.Strings(roles)
+
+	req.Header.Set(identityUserHeader, username)
+	req.Header.Set(identityRolesHeader, strings.Join(roles, ","))
+
+	signer := upstream.signer
+	if signer == nil {
+		return
+	}
+	token, err := signer.Sign(username, roles, time.Now())
+	if err != nil {
+		log.Printf("Ошибка подписи заголовков личности %s: %v", username, err)
+		return
+	}
+	req.Header.Set(signer.header, token)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// decodeIdentityToken разбирает JWT и возвращает подписанную часть, claims и подпись
+func decodeIdentityToken(t *testing.T, token string) (string, identityClaims, []byte) {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("ожидается JWT из трех частей, получено %d", len(parts))
+	}
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatalf("ошибка декодирования claims: %v", err)
+	}
+	var claims identityClaims
+	if err := json.Unmarshal(claimsJSON, &claims); err != nil {
+		t.Fatalf("ошибка разбора claims: %v", err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatalf("ошибка декодирования подписи: %v", err)
+	}
+	return parts[0] + "." + parts[1], claims, signature
+}
+
+func TestIdentitySignerHS256(t *testing.T) {
+	key := strings.Repeat("k", minIdentityHMACKeyLength)
+	upstream := UpstreamConfig{
+		Host: "rest.secure-proxy.lan",
+		Identity: UpstreamIdentityConfig{
+			Enabled: true,
+			JWT:     IdentityJWTConfig{Algorithm: jwtAlgorithmHS256, Key: key},
+		},
+	}
+	signer, err := newIdentitySigner(upstream)
+	if err != nil {
+		t.Fatalf("newIdentitySigner() error = %v", err)
+	}
+
+	now := time.Unix(1700000000, 0)
+	token, err := signer.Sign("waiter1", []string{"waiter"}, now)
+	if err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+
+	signingInput, claims, signature := decodeIdentityToken(t, token)
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(signingInput))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		t.Error("подпись HS256 не совпадает")
+	}
+
+	if claims.Subject != "waiter1" || claims.Audience != upstream.Host || claims.Issuer != defaultIdentityIssuer {
+		t.Errorf("claims = %+v", claims)
+	}
+	if claims.Expires-claims.IssuedAt != defaultIdentityTokenTTLSeconds {
+		t.Errorf("срок действия = %d сек, want %d", claims.Expires-claims.IssuedAt, defaultIdentityTokenTTLSeconds)
+	}
+}
+
+func TestIdentitySignerES256(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	signer, err := newIdentitySigner(UpstreamConfig{
+		Host: "rest.secure-proxy.lan",
+		Identity: UpstreamIdentityConfig{
+			Enabled: true,
+			JWT:     IdentityJWTConfig{Algorithm: jwtAlgorithmES256, Key: string(keyPEM), KeyID: "2026-01"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("newIdentitySigner() error = %v", err)
+	}
+
+	token, err := signer.Sign("manager", []string{"manager", "waiter"}, time.Now())
+	if err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+
+	signingInput, claims, signature := decodeIdentityToken(t, token)
+	if len(signature) != 64 {
+		t.Fatalf("длина подписи ES256 = %d, want 64", len(signature))
+	}
+	digest := sha256.Sum256([]byte(signingInput))
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(&privateKey.PublicKey, digest[:], r, s) {
+		t.Error("подпись ES256 не проверяется открытым ключом")
+	}
+	if len(claims.Roles) != 2 {
+		t.Errorf("roles = %v", claims.Roles)
+	}
+}
+
+func TestNewIdentitySignerErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		jwt  IdentityJWTConfig
+	}{
+		{"нет ключа", IdentityJWTConfig{Algorithm: jwtAlgorithmHS256}},
+		{"короткий ключ HS256", IdentityJWTConfig{Algorithm: jwtAlgorithmHS256, Key: "short"}},
+		{"ES256 не PEM", IdentityJWTConfig{Algorithm: jwtAlgorithmES256, Key: "not a pem"}},
+		{"неизвестный алгоритм", IdentityJWTConfig{Algorithm: "RS256", Key: strings.Repeat("k", 32)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := UpstreamConfig{Host: "rest.secure-proxy.lan", Identity: UpstreamIdentityConfig{Enabled: true, JWT: tt.jwt}}
+			if _, err := newIdentitySigner(upstream); err == nil {
+				t.Error("ожидалась ошибка")
+			}
+		})
+	}
+}
+
+func TestApplyIdentityHeadersStripsClientCopies(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "http://rest.secure-proxy.lan/orders", nil)
+	req.Header.Set(identityUserHeader, "admin")
+	req.Header.Set(identityRolesHeader, "admin")
+	req.Header.Set(defaultIdentityTokenHeader, "forged")
+
+	// Публичный маршрут: пользователя нет, клиентские заголовки должны исчезнуть
+	upstream := &upstreamProxy{config: UpstreamConfig{Identity: UpstreamIdentityConfig{Enabled: true}}}
+	applyIdentityHeaders(req, upstream, "")
+
+	for _, header := range []string{identityUserHeader, identityRolesHeader, defaultIdentityTokenHeader} {
+		if value := req.Header.Get(header); value != "" {
+			t.Errorf("заголовок %s = %q, ожидалось удаление", header, value)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// Package main - индексы ключей в Valkey.
+// Содержит явные множества-индексы пользователей, ролей и сессий и итерацию ключей через SCAN,
+// чтобы не блокировать Valkey командой KEYS.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/valkey-io/valkey-go"
+)
+
+// Ключи индексов в Valkey
+const (
+	usersIndexKey    = "users:all"
+	rolesIndexKey    = "roles:all"
+	sessionsIndexKey = "sessions:all"
+)
+
+// scanBatchSize - подсказка COUNT для SCAN: сколько ключей Valkey просматривает за один вызов
+const scanBatchSize = 500
+
+// scanKeys обходит ключи по шаблону курсором SCAN, не блокируя Valkey
+func scanKeys(ctx context.Context, pattern string) ([]string, error) {
+	var keys []string
+	var cursor uint64
+
+	for {
+		entry, err := valkeyClient.Do(ctx, valkeyClient.B().Scan().Cursor(cursor).Match(pattern).Count(scanBatchSize).Build()).AsScanEntry()
+		if err != nil {
+			return nil, fmt.Errorf("ошибка обхода ключей %s: %v", pattern, err)
+		}
+
+		keys = append(keys, entry.Elements...)
+		cursor = entry.Cursor
+		if cursor == 0 {
+			break
+		}
+	}
+
+	return keys, nil
+}
+
+// getIndexMembers возвращает элементы индекса
+func getIndexMembers(ctx context.Context, indexKey string) ([]string, error) {
+	members, err := valkeyClient.Do(ctx, valkeyClient.B().Smembers().Key(indexKey).Build()).AsStrSlice()
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения индекса %s: %v", indexKey, err)
+	}
+	return members, nil
+}
+
+// addToIndex добавляет элемент в индекс
+func addToIndex(ctx context.Context, indexKey, member string) error {
+	return valkeyClient.Do(ctx, valkeyClient.B().Sadd().Key(indexKey).Member(member).Build()).Error()
+}
+
+// removeFromIndex удаляет элементы из индекса
+func removeFromIndex(ctx context.Context, indexKey string, members ...string) {
+	if len(members) == 0 {
+		return
+	}
+	valkeyClient.Do(ctx, valkeyClient.B().Srem().Key(indexKey).Member(members...).Build())
+}
+
+// EnsureIndexes строит отсутствующие индексы по существующим ключам.
+// Нужна однократно для данных, записанных до появления индексов.
+func EnsureIndexes() error {
+	ctx := context.Background()
+
+	builders := []struct {
+		indexKey string
+		build    func(ctx context.Context) ([]string, error)
+	}{
+		{usersIndexKey, scanUsernames},
+		{rolesIndexKey, scanRoleNames},
+		{sessionsIndexKey, scanSessionIDs},
+	}
+
+	for _, builder := range builders {
+		exists, err := valkeyClient.Do(ctx, valkeyClient.B().Exists().Key(builder.indexKey).Build()).AsInt64()
+		if err != nil {
+			return fmt.Errorf("ошибка проверки индекса %s: %v", builder.indexKey, err)
+		}
+		if exists == 1 {
+			continue
+		}
+
+		members, err := builder.build(ctx)
+		if err != nil {
+			return err
+		}
+		if len(members) == 0 {
+			continue
+		}
+
+		err = valkeyClient.Do(ctx, valkeyClient.B().Sadd().Key(builder.indexKey).Member(members...).Build()).Error()
+		if err != nil {
+			return fmt.Errorf("ошибка построения индекса %s: %v", builder.indexKey, err)
+		}
+		log.Printf("Построен индекс %s: %d элементов", builder.indexKey, len(members))
+	}
+
+	return nil
+}
+
+// scanUsernames находит пользователей среди ключей user:*.
+// Под тем же префиксом лежат служебные ключи (роли, TOTP), поэтому каждое значение проверяется.
+func scanUsernames(ctx context.Context) ([]string, error) {
+	keys, err := scanKeys(ctx, userKeyPrefix+"*")
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+
+	cmds := make(valkey.Commands, 0, len(keys))
+	for _, key := range keys {
+		cmds = append(cmds, valkeyClient.B().Get().Key(key).Build())
+	}
+
+	var usernames []string
+	for i, result := range valkeyClient.DoMulti(ctx, cmds...) {
+		userJSON, err := result.ToString()
+		if err != nil {
+			continue
+		}
+		var user ValkeyUser
+		if json.Unmarshal([]byte(userJSON), &user) != nil {
+			continue
+		}
+		usernames = append(usernames, strings.TrimPrefix(keys[i], userKeyPrefix))
+	}
+
+	return usernames, nil
+}
+
+// scanRoleNames находит роли по ключам role:permissions:*
+func scanRoleNames(ctx context.Context) ([]string, error) {
+	keys, err := scanKeys(ctx, rolePermissionsPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+
+	roleNames := make([]string, 0, len(keys))
+	for _, key := range keys {
+		roleNames = append(roleNames, strings.TrimPrefix(key, rolePermissionsPrefix))
+	}
+	return roleNames, nil
+}
+
+// scanSessionIDs находит сессии по ключам session:*
+func scanSessionIDs(ctx context.Context) ([]string, error) {
+	keys, err := scanKeys(ctx, sessionKeyPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+
+	sessionIDs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		sessionIDs = append(sessionIDs, strings.TrimPrefix(key, sessionKeyPrefix))
+	}
+	return sessionIDs, nil
+}
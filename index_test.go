@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// indexMembers возвращает отсортированные элементы индекса
+func indexMembers(t *testing.T, indexKey string) []string {
+	t.Helper()
+	members, err := getIndexMembers(context.Background(), indexKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(members)
+	return members
+}
+
+func TestIndexesFollowCreateAndDelete(t *testing.T) {
+	setupTestValkey(t)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "https://auth.secure-proxy.lan/login", nil)
+
+	if err := SaveUser("waiter", "", []string{"waiter"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveUser("kitchen", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetRolePermissions("waiter", []string{"rest.secure-proxy.lan/waiter"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetRolePermissions("empty", nil); err != nil {
+		t.Fatal(err)
+	}
+	sessionID, err := CreateSession(c, "waiter", loginMethodTOTP, SessionBindingPolicy{Mode: sessionBindingOff})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created := []struct {
+		indexKey string
+		want     []string
+	}{
+		{usersIndexKey, []string{"kitchen", "waiter"}},
+		{rolesIndexKey, []string{"empty", "waiter"}},
+		{sessionsIndexKey, []string{sessionID}},
+	}
+	for _, tt := range created {
+		if got := indexMembers(t, tt.indexKey); !slices.Equal(got, tt.want) {
+			t.Errorf("после создания %s = %v, want %v", tt.indexKey, got, tt.want)
+		}
+	}
+
+	if err := DeleteUser("kitchen"); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteRole("empty"); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteSession(sessionID); err != nil {
+		t.Fatal(err)
+	}
+
+	deleted := []struct {
+		indexKey string
+		want     []string
+	}{
+		{usersIndexKey, []string{"waiter"}},
+		{rolesIndexKey, []string{"waiter"}},
+		{sessionsIndexKey, nil},
+	}
+	for _, tt := range deleted {
+		if got := indexMembers(t, tt.indexKey); !slices.Equal(got, tt.want) {
+			t.Errorf("после удаления %s = %v, want %v", tt.indexKey, got, tt.want)
+		}
+	}
+}
+
+func TestGetAllUsersDropsMissingFromIndex(t *testing.T) {
+	server := setupTestValkey(t)
+	if err := SaveUser("waiter", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	// Пользователь удален в обход DeleteUser
+	server.SAdd(usersIndexKey, "ghost")
+
+	users, err := GetAllUsers()
+	if err != nil || len(users) != 1 || users["waiter"] == nil {
+		t.Fatalf("GetAllUsers() = %v, %v; want только waiter", users, err)
+	}
+	if got := indexMembers(t, usersIndexKey); !slices.Equal(got, []string{"waiter"}) {
+		t.Errorf("%s = %v, want [waiter]", usersIndexKey, got)
+	}
+}
+
+func TestEnsureIndexes(t *testing.T) {
+	server := setupTestValkey(t)
+
+	// Данные, записанные до появления индексов
+	server.Set(getUserKey("waiter"), `{"roles":["waiter"]}`)
+	server.Set(getUserKey("kitchen"), `{"totpSecret":"VGLFTEMMJYNRCC36PNS6ZCURQPLYAXRY"}`)
+	server.SAdd(getRolePermissionsKey("waiter"), "rest.secure-proxy.lan/waiter")
+	server.HSet(getSessionKey("tablet-1"), sessionFieldUsername, "waiter")
+	server.HSet(getSessionKey("tablet-2"), sessionFieldUsername, "kitchen")
+
+	// Служебные ключи под префиксом user: не являются пользователями
+	server.SAdd(getUserRolesKey("waiter"), "waiter")
+	server.SAdd(getUserSessionsKey("waiter"), "tablet-1")
+	server.Set(getUserTOTPLastStepKey("waiter"), "56666666")
+	server.Set(getUserTOTPQRPendingKey("kitchen"), "1")
+
+	if err := EnsureIndexes(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		indexKey string
+		want     []string
+	}{
+		{"пользователи без служебных ключей", usersIndexKey, []string{"kitchen", "waiter"}},
+		{"роли", rolesIndexKey, []string{"waiter"}},
+		{"сессии", sessionsIndexKey, []string{"tablet-1", "tablet-2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := indexMembers(t, tt.indexKey); !slices.Equal(got, tt.want) {
+				t.Errorf("%s = %v, want %v", tt.indexKey, got, tt.want)
+			}
+		})
+	}
+
+	// Существующий индекс не перестраивается при следующем запуске
+	server.SAdd(getRolePermissionsKey("manager"), "secure-proxy:admin")
+	if err := EnsureIndexes(); err != nil {
+		t.Fatal(err)
+	}
+	if got := indexMembers(t, rolesIndexKey); !slices.Equal(got, []string{"waiter"}) {
+		t.Errorf("%s после повторного запуска = %v, want [waiter]", rolesIndexKey, got)
+	}
+}
@@ -0,0 +1,247 @@
+// Package main - защита входа от перебора.
+// Содержит счетчики неудачных попыток входа по имени пользователя и IP клиента,
+// экспоненциальную задержку между попытками и временную блокировку.
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Области учета неудачных попыток входа
+const (
+	loginScopeUser = "user"
+	loginScopeIP   = "ip"
+)
+
+// Ключи для хранения в Valkey
+const (
+	loginFailuresPrefix = "login:failures:"
+	loginBackoffPrefix  = "login:backoff:"
+	loginLockoutPrefix  = "login:lockout:"
+)
+
+const (
+	defaultMaxFailuresPerUser   = 5
+	defaultMaxFailuresPerIP     = 20
+	defaultFailureWindowSeconds = 900
+	defaultLockoutSeconds       = 900
+	defaultBackoffBaseSeconds   = 1
+	defaultBackoffMaxSeconds    = 60
+)
+
+// LoginThrottle описывает ограничение, действующее на попытку входа
+type LoginThrottle struct {
+	Locked     bool
+	RetryAfter time.Duration
+}
+
+type LockoutResponse struct {
+	Scope      string `json:"scope"`
+	Identifier string `json:"identifier"`
+	Failures   int64  `json:"failures"`
+	TTL        int64  `json:"ttl"`
+}
+
+func getLoginFailuresKey(scope, identifier string) string {
+	return loginFailuresPrefix + scope + ":" + identifier
+}
+
+func getLoginBackoffKey(scope, identifier string) string {
+	return loginBackoffPrefix + scope + ":" + identifier
+}
+
+func getLoginLockoutKey(scope, identifier string) string {
+	return loginLockoutPrefix + scope + ":" + identifier
+}
+
+func getMaxLoginFailures(scope string) int64 {
+	if scope == loginScopeIP {
+		if config != nil && config.Security.Login.MaxFailuresPerIP > 0 {
+			return int64(config.Security.Login.MaxFailuresPerIP)
+		}
+		return defaultMaxFailuresPerIP
+	}
+	if config != nil && config.Security.Login.MaxFailuresPerUser > 0 {
+		return int64(config.Security.Login.MaxFailuresPerUser)
+	}
+	return defaultMaxFailuresPerUser
+}
+
+func getFailureWindow() time.Duration {
+	if config != nil && config.Security.Login.FailureWindowSeconds > 0 {
+		return time.Duration(config.Security.Login.FailureWindowSeconds) * time.Second
+	}
+	return defaultFailureWindowSeconds * time.Second
+}
+
+func getLockoutDuration() time.Duration {
+	if config != nil && config.Security.Login.LockoutSeconds > 0 {
+		return time.Duration(config.Security.Login.LockoutSeconds) * time.Second
+	}
+	return defaultLockoutSeconds * time.Second
+}
+
+func getBackoffLimits() (time.Duration, time.Duration) {
+	base := time.Duration(defaultBackoffBaseSeconds) * time.Second
+	max := time.Duration(defaultBackoffMaxSeconds) * time.Second
+	if config != nil && config.Security.Login.BackoffBaseSeconds > 0 {
+		base = time.Duration(config.Security.Login.BackoffBaseSeconds) * time.Second
+	}
+	if config != nil && config.Security.Login.BackoffMaxSeconds > 0 {
+		max = time.Duration(config.Security.Login.BackoffMaxSeconds) * time.Second
+	}
+	return base, max
+}
+
+// loginBackoffDelay вычисляет задержку перед следующей попыткой: base * 2^(failures-1), не более max
+func loginBackoffDelay(failures int64, base, max time.Duration) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	delay := base
+	for i := int64(1); i < failures; i++ {
+		delay *= 2
+		if delay >= max {
+			return max
+		}
+	}
+	if delay > max {
+		return max
+	}
+	return delay
+}
+
+// loginThrottleSubjects возвращает пары (область, идентификатор), по которым учитываются попытки входа
+func loginThrottleSubjects(username, clientIP string) [][2]string {
+	subjects := make([][2]string, 0, 2)
+	if username != "" {
+		subjects = append(subjects, [2]string{loginScopeUser, username})
+	}
+	if clientIP != "" {
+		subjects = append(subjects, [2]string{loginScopeIP, clientIP})
+	}
+	return subjects
+}
+
+// CheckLoginThrottle проверяет, разрешена ли попытка входа для пользователя и IP клиента
+func CheckLoginThrottle(username, clientIP string) LoginThrottle {
+	ctx := context.Background()
+	var throttle LoginThrottle
+
+	for _, subject := range loginThrottleSubjects(username, clientIP) {
+		lockoutTTL, err := valkeyClient.Do(ctx, valkeyClient.B().Pttl().Key(getLoginLockoutKey(subject[0], subject[1])).Build()).AsInt64()
+		if err == nil && lockoutTTL > 0 {
+			retryAfter := time.Duration(lockoutTTL) * time.Millisecond
+			if !throttle.Locked || retryAfter > throttle.RetryAfter {
+				throttle = LoginThrottle{Locked: true, RetryAfter: retryAfter}
+			}
+			continue
+		}
+		if throttle.Locked {
+			continue
+		}
+
+		backoffTTL, err := valkeyClient.Do(ctx, valkeyClient.B().Pttl().Key(getLoginBackoffKey(subject[0], subject[1])).Build()).AsInt64()
+		if err == nil && backoffTTL > 0 {
+			retryAfter := time.Duration(backoffTTL) * time.Millisecond
+			if retryAfter > throttle.RetryAfter {
+				throttle.RetryAfter = retryAfter
+			}
+		}
+	}
+
+	return throttle
+}
+
+// RegisterLoginFailure увеличивает счетчики неудачных попыток и при превышении порога блокирует вход
+func RegisterLoginFailure(username, clientIP string) {
+	ctx := context.Background()
+	window := getFailureWindow()
+	backoffBase, backoffMax := getBackoffLimits()
+
+	for _, subject := range loginThrottleSubjects(username, clientIP) {
+		scope, identifier := subject[0], subject[1]
+		failuresKey := getLoginFailuresKey(scope, identifier)
+
+		failures, err := valkeyClient.Do(ctx, valkeyClient.B().Incr().Key(failuresKey).Build()).AsInt64()
+		if err != nil {
+			continue
+		}
+		if failures == 1 {
+			valkeyClient.Do(ctx, valkeyClient.B().Expire().Key(failuresKey).Seconds(int64(window.Seconds())).Build())
+		}
+
+		if failures >= getMaxLoginFailures(scope) {
+			lockout := getLockoutDuration()
+			valkeyClient.Do(ctx, valkeyClient.B().Set().Key(getLoginLockoutKey(scope, identifier)).Value(fmt.Sprint(failures)).Px(lockout).Build())
+			continue
+		}
+
+		delay := loginBackoffDelay(failures, backoffBase, backoffMax)
+		valkeyClient.Do(ctx, valkeyClient.B().Set().Key(getLoginBackoffKey(scope, identifier)).Value(fmt.Sprint(failures)).Px(delay).Build())
+	}
+}
+
+// ResetLoginFailures сбрасывает счетчики пользователя после успешного входа.
+// Счетчик IP не сбрасывается, чтобы перебор по разным именам с одного адреса оставался заметен.
+func ResetLoginFailures(username string) {
+	ctx := context.Background()
+	valkeyClient.Do(ctx, valkeyClient.B().Del().Key(
+		getLoginFailuresKey(loginScopeUser, username),
+		getLoginBackoffKey(loginScopeUser, username),
+	).Build())
+}
+
+// GetAllLockouts возвращает действующие блокировки входа
+func GetAllLockouts() ([]LockoutResponse, error) {
+	ctx := context.Background()
+	lockouts := []LockoutResponse{}
+
+	keys, err := scanKeys(ctx, loginLockoutPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		parts := strings.SplitN(strings.TrimPrefix(key, loginLockoutPrefix), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		ttl, err := valkeyClient.Do(ctx, valkeyClient.B().Ttl().Key(key).Build()).AsInt64()
+		if err != nil || ttl <= 0 {
+			continue
+		}
+
+		failures, err := valkeyClient.Do(ctx, valkeyClient.B().Get().Key(getLoginFailuresKey(parts[0], parts[1])).Build()).AsInt64()
+		if err != nil {
+			failures = 0
+		}
+
+		lockouts = append(lockouts, LockoutResponse{
+			Scope:      parts[0],
+			Identifier: parts[1],
+			Failures:   failures,
+			TTL:        ttl,
+		})
+	}
+
+	return lockouts, nil
+}
+
+// ClearLockout снимает блокировку и сбрасывает счетчики для области и идентификатора
+func ClearLockout(scope, identifier string) error {
+	if scope != loginScopeUser && scope != loginScopeIP {
+		return fmt.Errorf("неизвестная область блокировки: %s", scope)
+	}
+
+	ctx := context.Background()
+	return valkeyClient.Do(ctx, valkeyClient.B().Del().Key(
+		getLoginLockoutKey(scope, identifier),
+		getLoginFailuresKey(scope, identifier),
+		getLoginBackoffKey(scope, identifier),
+	).Build()).Error()
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestLoginBackoffDelay(t *testing.T) {
+	base, max := time.Second, 60*time.Second
+
+	tests := []struct {
+		failures int64
+		want     time.Duration
+	}{
+		{0, 0},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{6, 32 * time.Second},
+		{7, 60 * time.Second},
+		{50, 60 * time.Second},
+	}
+
+	for _, tt := range tests {
+		if got := loginBackoffDelay(tt.failures, base, max); got != tt.want {
+			t.Errorf("loginBackoffDelay(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func setupLockoutConfig(t *testing.T) {
+	t.Helper()
+	saved := config
+	config = &Config{Security: SecurityConfig{Login: LoginProtectionConfig{
+		MaxFailuresPerUser: 3,
+		MaxFailuresPerIP:   5,
+		LockoutSeconds:     600,
+		BackoffBaseSeconds: 1,
+		BackoffMaxSeconds:  60,
+	}}}
+	t.Cleanup(func() { config = saved })
+}
+
+func TestLoginThrottleTransitions(t *testing.T) {
+	tests := []struct {
+		name        string
+		failures    int
+		wantLocked  bool
+		wantBackoff bool
+	}{
+		{"без ошибок", 0, false, false},
+		{"одна ошибка - задержка", 1, false, true},
+		{"ниже порога - задержка", 2, false, true},
+		{"порог пользователя - блокировка", 3, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestValkey(t)
+			setupLockoutConfig(t)
+
+			for i := 0; i < tt.failures; i++ {
+				RegisterLoginFailure("waiter", "10.0.0.7")
+			}
+
+			throttle := CheckLoginThrottle("waiter", "10.0.0.7")
+			if throttle.Locked != tt.wantLocked {
+				t.Errorf("Locked = %v, want %v", throttle.Locked, tt.wantLocked)
+			}
+			if (throttle.RetryAfter > 0) != tt.wantBackoff {
+				t.Errorf("RetryAfter = %v, want задержку: %v", throttle.RetryAfter, tt.wantBackoff)
+			}
+			if tt.wantLocked && throttle.RetryAfter <= 60*time.Second {
+				t.Errorf("RetryAfter = %v, want срок блокировки 600s", throttle.RetryAfter)
+			}
+		})
+	}
+}
+
+func TestResetLoginFailures(t *testing.T) {
+	tests := []struct {
+		name        string
+		username    string
+		clientIP    string
+		wantBackoff bool
+	}{
+		// Успешный вход сбрасывает счетчики пользователя
+		{"пользователь после сброса", "waiter", "", false},
+		// Счетчик IP сохраняется, чтобы перебор имен с одного адреса оставался заметен
+		{"IP после сброса пользователя", "", "10.0.0.7", true},
+		{"пользователь с тем же IP", "waiter", "10.0.0.7", true},
+		{"другой пользователь не затронут", "kitchen", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestValkey(t)
+			setupLockoutConfig(t)
+
+			RegisterLoginFailure("waiter", "10.0.0.7")
+			RegisterLoginFailure("kitchen", "")
+			ResetLoginFailures("waiter")
+
+			throttle := CheckLoginThrottle(tt.username, tt.clientIP)
+			if (throttle.RetryAfter > 0) != tt.wantBackoff {
+				t.Errorf("RetryAfter = %v, want задержку: %v", throttle.RetryAfter, tt.wantBackoff)
+			}
+		})
+	}
+}
+
+func TestHandleDeleteLockout(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+		wantLocked bool
+	}{
+		{"снятие блокировки пользователя", "/lockouts/user/waiter", http.StatusOK, false},
+		{"блокировка другой области остается", "/lockouts/ip/waiter", http.StatusOK, true},
+		{"неизвестная область", "/lockouts/host/waiter", http.StatusBadRequest, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestValkey(t)
+			setupLockoutConfig(t)
+			gin.SetMode(gin.ReleaseMode)
+
+			for i := 0; i < 3; i++ {
+				RegisterLoginFailure("waiter", "")
+			}
+			lockouts, err := GetAllLockouts()
+			if err != nil || len(lockouts) != 1 || lockouts[0].Scope != loginScopeUser || lockouts[0].Failures != 3 {
+				t.Fatalf("GetAllLockouts() = %+v, %v; want блокировку пользователя после 3 ошибок", lockouts, err)
+			}
+
+			engine := gin.New()
+			engine.DELETE("/lockouts/:scope/:identifier", handleDeleteLockout)
+			recorder := httptest.NewRecorder()
+			engine.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, tt.path, nil))
+
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("статус %d, want %d", recorder.Code, tt.wantStatus)
+			}
+			if locked := CheckLoginThrottle("waiter", "").Locked; locked != tt.wantLocked {
+				t.Errorf("Locked = %v, want %v", locked, tt.wantLocked)
+			}
+		})
+	}
+}
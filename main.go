@@ -23,12 +23,51 @@ func main() {
 		log.Fatal("Ошибка чтения конфигурации:", err)
 	}
 
+	err = LoadTrustedProxies()
+	if err != nil {
+		log.Fatal("Ошибка чтения доверенных прокси:", err)
+	}
+
+	err = LoadUpstreams(config.Upstreams)
+	if err != nil {
+		log.Fatal("Ошибка настройки upstream:", err)
+	}
+	go watchUpstreamReload()
+
+	totpKeyring, err = LoadTOTPKeyring()
+	if err != nil {
+		log.Fatal("Ошибка загрузки ключей шифрования TOTP:", err)
+	}
+	if totpKeyring == nil {
+		log.Println("Предупреждение: TOTP_KEYS и TOTP_KEYS_FILE не заданы, TOTP секреты хранятся в Valkey открытым текстом")
+	}
+
 	valkeyClient, err = NewValkeyClient()
 	if err != nil {
 		log.Fatal("Ошибка подключения к Valkey:", err)
 	}
 	defer valkeyClient.Close()
 
+	err = MigrateLegacySessions()
+	if err != nil {
+		log.Fatal("Ошибка миграции сессий:", err)
+	}
+
+	err = EnsureIndexes()
+	if err != nil {
+		log.Fatal("Ошибка построения индексов Valkey:", err)
+	}
+
+	// Команда ротации: перешифровать все TOTP секреты активным ключом и завершиться
+	if len(os.Args) > 1 && os.Args[1] == "rotate-totp-keys" {
+		count, err := ReencryptAllUsers()
+		if err != nil {
+			log.Fatal("Ошибка перешифрования TOTP секретов:", err)
+		}
+		log.Printf("Перешифровано пользователей: %d (активный ключ %s)", count, totpKeyring.ActiveKeyID())
+		return
+	}
+
 	// Опциональная миграция пользователей из config.yaml в Valkey (только если указана переменная окружения)
 	if os.Getenv("MIGRATE_FROM_CONFIG") == "true" {
 		log.Println("Запуск миграции пользователей из config.yaml...")
@@ -63,27 +102,43 @@ func main() {
 
 func startAuthServer() error {
 	auth := gin.Default()
+	if err := applyTrustedProxies(auth); err != nil {
+		return fmt.Errorf("ошибка настройки доверенных прокси: %v", err)
+	}
 	auth.LoadHTMLGlob("templates/*")
 
 	auth.GET("/", func(c *gin.Context) {
-		c.HTML(http.StatusOK, "login.html", gin.H{
+		renderLoginPage(c, http.StatusOK, gin.H{
 			"redirectUrl": c.Query("redirectUrl"),
 		})
 	})
 
 	auth.POST("/login", handleLogin)
-	auth.GET("/admin", func(c *gin.Context) {
-		c.HTML(http.StatusOK, "admin.html", gin.H{})
+	auth.GET("/admin", adminPageMiddleware(), func(c *gin.Context) {
+		c.HTML(http.StatusOK, "admin.html", gin.H{
+			"csrfToken": ensureCSRFToken(c),
+		})
 	})
 
+	// API управления доступно только администраторам, изменяющие запросы требуют CSRF токен
 	api := auth.Group("/api")
+	api.Use(adminAPIMiddleware(), csrfMiddleware())
 	{
 		api.GET("/users", handleGetUsers)
 		api.POST("/users", handleCreateUser)
 		api.PUT("/users/:username", handleUpdateUser)
 		api.DELETE("/users/:username", handleDeleteUser)
+		api.DELETE("/users/:username/sessions", handleDeleteUserSessions)
+		api.POST("/users/:username/totp/reset", handleResetUserTOTP)
+		api.GET("/users/:username/totp/qr.png", handleGetUserTOTPQR)
+		api.GET("/users/:username/tokens", handleGetAPITokens)
+		api.POST("/users/:username/tokens", handleCreateAPIToken)
+		api.DELETE("/users/:username/tokens/:id", handleDeleteAPIToken)
 		api.GET("/sessions", handleGetSessions)
 		api.DELETE("/sessions/:key", handleDeleteSession)
+		api.GET("/upstreams", handleGetUpstreams)
+		api.GET("/lockouts", handleGetLockouts)
+		api.DELETE("/lockouts/:scope/:identifier", handleDeleteLockout)
 
 		// API для управления ролями
 		api.GET("/roles", handleGetRoles)
@@ -98,8 +153,11 @@ func startAuthServer() error {
 
 func startProxyServer() {
 	proxy := gin.Default()
+	if err := applyTrustedProxies(proxy); err != nil {
+		log.Fatalf("Ошибка настройки доверенных прокси: %v", err)
+	}
 	proxy.LoadHTMLGlob("templates/*")
-	proxy.POST("/logout", handleLogout)
+	proxy.POST("/logout", csrfMiddleware(), handleLogout)
 
 	// Публичные маршруты (без аутентификации) для пассажиров
 	proxy.Any("/passenger", handlePublicProxy)
@@ -5,7 +5,6 @@ package main
 import (
 	"net/http"
 	"net/http/httputil"
-	"net/url"
 	"strings"
 
 	"github.com/gin-gonic/gin"
@@ -15,26 +14,12 @@ import (
 func handlePublicProxy(c *gin.Context) {
 	c.Request.Host = strings.Split(c.Request.Host, ":")[0]
 
-	var upstream *UpstreamConfig
-	for _, u := range config.Upstreams {
-		if u.Host == c.Request.Host {
-			upstream = &u
-			break
-		}
-	}
-
+	upstream := lookupUpstream(c.Request.Host)
 	if upstream == nil {
 		c.String(http.StatusNotFound, "Upstream не найден: %s", c.Request.Host)
 		return
 	}
 
-	// Публичные маршруты - пропускаем без проверки доступа
-	target, err := url.Parse(upstream.Destination)
-	if err != nil {
-		c.String(http.StatusInternalServerError, "Ошибка парсинга upstream: %v", err)
-		return
-	}
-
 	// Обработка OPTIONS запросов для CORS (до проксирования)
 	if c.Request.Method == "OPTIONS" {
 		c.Header("Access-Control-Allow-Origin", "*")
@@ -45,23 +30,15 @@ func handlePublicProxy(c *gin.Context) {
 		return
 	}
 
-	proxy := httputil.NewSingleHostReverseProxy(target)
-	configureProxyDirector(proxy, c)
-	proxy.ServeHTTP(c.Writer, c.Request)
+	// Публичные маршруты - пропускаем без проверки доступа
+	serveUpstream(c, upstream)
 }
 
 // handleProxy обрабатывает защищенные запросы с проверкой аутентификации и авторизации
 func handleProxy(c *gin.Context) {
 	c.Request.Host = strings.Split(c.Request.Host, ":")[0]
 
-	var upstream *UpstreamConfig
-	for _, u := range config.Upstreams {
-		if u.Host == c.Request.Host {
-			upstream = &u
-			break
-		}
-	}
-
+	upstream := lookupUpstream(c.Request.Host)
 	if upstream == nil {
 		c.String(http.StatusNotFound, "Upstream не найден: %s", c.Request.Host)
 		return
@@ -77,27 +54,33 @@ func handleProxy(c *gin.Context) {
 		return
 	}
 
-	target, err := url.Parse(upstream.Destination)
-	if err != nil {
-		c.String(http.StatusInternalServerError, "Ошибка парсинга upstream: %v", err)
-		return
-	}
-
-	proxy := httputil.NewSingleHostReverseProxy(target)
-	configureProxyDirector(proxy, c)
-	proxy.ServeHTTP(c.Writer, c.Request)
+	serveUpstream(c, upstream)
 }
 
-// configureProxyDirector настраивает директор прокси для правильной передачи пути и заголовков
-func configureProxyDirector(proxy *httputil.ReverseProxy, c *gin.Context) {
-	originalDirector := proxy.Director
+// configureProxyDirector настраивает директор прокси для правильной передачи пути и заголовков.
+// Прокси общий для всех запросов upstream, поэтому gin.Context и выбранный адрес берутся из контекста запроса.
+func configureProxyDirector(proxy *httputil.ReverseProxy, upstream *upstreamProxy) {
 	proxy.Director = func(req *http.Request) {
-		originalDirector(req)
-		req.URL.Path = c.Request.URL.Path
+		attempt := proxyAttemptFromRequest(req)
+		if attempt == nil {
+			return
+		}
+		c := attempt.c
+
+		req.URL.Scheme = attempt.destination.url.Scheme
+		req.URL.Host = attempt.destination.url.Host
+		if _, ok := req.Header["User-Agent"]; !ok {
+			// Пустое значение не дает http.Client подставить свой User-Agent
+			req.Header.Set("User-Agent", "")
+		}
+		upstream.rewriter.rewriteRequest(req.URL, c.Request.URL, attempt.destination.url)
 		req.URL.RawQuery = c.Request.URL.RawQuery
+		sanitizeUpstreamHeaders(req.Header, c.RemoteIP(), &upstream.config, trustedProxyPrefixes)
 		req.Header.Set("X-Forwarded-Proto", "https")
 		req.Header.Set("X-Forwarded-Host", c.Request.Host)
 		req.Header.Set("X-Real-IP", c.ClientIP())
 		req.Method = c.Request.Method
+		applyIdentityHeaders(req, upstream, c.GetString("username"))
+		forceUpstreamHeaders(req.Header, &upstream.config)
 	}
 }
@@ -0,0 +1,61 @@
+// Package main - ответы прокси при недоступности upstream и нарушении ограничений запроса.
+// Браузер получает HTML страницу с объяснением, API клиент - JSON ошибку.
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// proxyErrorText - заголовок и пояснение ошибки для пользователя
+type proxyErrorText struct {
+	title   string
+	message string
+}
+
+var proxyErrorTexts = map[int]proxyErrorText{
+	http.StatusRequestTimeout: {
+		title:   "Время запроса истекло",
+		message: "Запрос передавался слишком долго. Проверьте соединение и повторите попытку.",
+	},
+	http.StatusRequestEntityTooLarge: {
+		title:   "Слишком большой запрос",
+		message: "Размер запроса превышает допустимый. Уменьшите объем данных или размер файла.",
+	},
+	http.StatusBadGateway: {
+		title:   "Сервис недоступен",
+		message: "Сервис не отвечает. Попробуйте повторить запрос позже.",
+	},
+	http.StatusServiceUnavailable: {
+		title:   "Сервис недоступен",
+		message: "Сервис временно недоступен. Попробуйте повторить запрос через несколько минут.",
+	},
+	http.StatusGatewayTimeout: {
+		title:   "Сервис не ответил вовремя",
+		message: "Сервис не успел обработать запрос. Попробуйте повторить запрос позже.",
+	},
+}
+
+func getProxyErrorText(status int) proxyErrorText {
+	if text, ok := proxyErrorTexts[status]; ok {
+		return text
+	}
+	return proxyErrorText{title: http.StatusText(status), message: http.StatusText(status)}
+}
+
+// renderProxyError отвечает ошибкой прокси: JSON для API запросов, HTML страница для браузера
+func renderProxyError(c *gin.Context, status int) {
+	text := getProxyErrorText(status)
+	if isAPIRequest(c, c.Request.URL.Path) {
+		c.AbortWithStatusJSON(status, gin.H{"detail": text.message})
+		return
+	}
+
+	c.HTML(status, "proxy_error.html", gin.H{
+		"status":  status,
+		"title":   text.title,
+		"message": text.message,
+	})
+	c.Abort()
+}
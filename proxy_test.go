@@ -0,0 +1,380 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// legacyPublicProxy повторяет прежнюю схему: поиск перебором, url.Parse и новый прокси на каждый запрос.
+// Директор выполняет ту же работу с заголовками, что и общий прокси, чтобы сравнивались только накладные расходы.
+func legacyPublicProxy(c *gin.Context) {
+	var upstream *UpstreamConfig
+	for _, u := range config.Upstreams {
+		if u.Host == c.Request.Host {
+			upstream = &u
+			break
+		}
+	}
+	target, _ := url.Parse(upstream.Destination)
+	shared := &upstreamProxy{config: *upstream}
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	originalDirector := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		originalDirector(req)
+		req.URL.Path = c.Request.URL.Path
+		req.URL.RawQuery = c.Request.URL.RawQuery
+		sanitizeUpstreamHeaders(req.Header, c.RemoteIP(), upstream, trustedProxyPrefixes)
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Forwarded-Host", c.Request.Host)
+		req.Header.Set("X-Real-IP", c.ClientIP())
+		req.Method = c.Request.Method
+		applyIdentityHeaders(req, shared, c.GetString("username"))
+		forceUpstreamHeaders(req.Header, upstream)
+	}
+	proxy.ServeHTTP(c.Writer, c.Request)
+}
+
+// setupProxyBenchmark поднимает тестовый backend и настраивает на него upstream
+func setupProxyBenchmark(b *testing.B) *httptest.Server {
+	b.Helper()
+	gin.SetMode(gin.ReleaseMode)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+
+	upstreams := []UpstreamConfig{
+		{Host: "kitchen.secure-proxy.lan", Destination: "http://127.0.0.1:1"},
+		{Host: "warehouse.secure-proxy.lan", Destination: "http://127.0.0.1:2"},
+		{Host: "rest.secure-proxy.lan", Destination: backend.URL},
+	}
+	loadTestUpstreams(b, upstreams)
+	b.Cleanup(backend.Close)
+	return backend
+}
+
+// loadTestUpstreams загружает upstream на время теста и восстанавливает прежние конфигурацию и реестр
+func loadTestUpstreams(tb testing.TB, upstreams []UpstreamConfig) {
+	tb.Helper()
+	saved, savedRegistry := config, currentUpstreams.Load()
+	config = &Config{Upstreams: upstreams}
+	if err := LoadUpstreams(upstreams); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		closeUpstreams(currentUpstreams.Swap(savedRegistry))
+		config = saved
+	})
+}
+
+// closeNotifyRecorder нужен gin при проксировании: httptest.ResponseRecorder не реализует CloseNotifier
+type closeNotifyRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (r closeNotifyRecorder) CloseNotify() <-chan bool {
+	return nil
+}
+
+func newBenchmarkRequest() *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "http://rest.secure-proxy.lan/passenger/menu", nil)
+	req.Host = "rest.secure-proxy.lan"
+	return req
+}
+
+func runProxyBenchmark(b *testing.B, handler gin.HandlerFunc) {
+	engine := gin.New()
+	engine.NoRoute(handler)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		recorder := closeNotifyRecorder{httptest.NewRecorder()}
+		engine.ServeHTTP(recorder, newBenchmarkRequest())
+		if recorder.Code != http.StatusOK {
+			b.Fatalf("статус ответа %d", recorder.Code)
+		}
+	}
+}
+
+// runParallelProxyBenchmark - одновременные запросы, как от нескольких планшетов официантов:
+// здесь сказывается размер пула keep-alive соединений (у http.DefaultTransport 2 на хост)
+func runParallelProxyBenchmark(b *testing.B, handler gin.HandlerFunc) {
+	engine := gin.New()
+	engine.NoRoute(handler)
+
+	b.ReportAllocs()
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			recorder := closeNotifyRecorder{httptest.NewRecorder()}
+			engine.ServeHTTP(recorder, newBenchmarkRequest())
+			if recorder.Code != http.StatusOK {
+				b.Errorf("статус ответа %d", recorder.Code)
+				return
+			}
+		}
+	})
+}
+
+// BenchmarkProxyPerRequest - прокси создается на каждый запрос
+func BenchmarkProxyPerRequest(b *testing.B) {
+	setupProxyBenchmark(b)
+	runProxyBenchmark(b, legacyPublicProxy)
+}
+
+// BenchmarkProxyShared - прокси и транспорт создаются один раз при загрузке upstream
+func BenchmarkProxyShared(b *testing.B) {
+	setupProxyBenchmark(b)
+	runProxyBenchmark(b, handlePublicProxy)
+}
+
+func BenchmarkProxyPerRequestParallel(b *testing.B) {
+	setupProxyBenchmark(b)
+	runParallelProxyBenchmark(b, legacyPublicProxy)
+}
+
+func BenchmarkProxySharedParallel(b *testing.B) {
+	setupProxyBenchmark(b)
+	runParallelProxyBenchmark(b, handlePublicProxy)
+}
+
+func TestBuildUpstreamRegistry(t *testing.T) {
+	registry, err := buildUpstreamRegistry([]UpstreamConfig{
+		{Host: "rest.secure-proxy.lan", Destination: "http://backend:8000"},
+		{Host: "Kitchen.secure-proxy.lan", Destination: "https://kitchen:8443"},
+	})
+	if err != nil {
+		t.Fatalf("buildUpstreamRegistry() error = %v", err)
+	}
+	if registry.byHost["kitchen.secure-proxy.lan"] == nil {
+		t.Error("поиск upstream должен не зависеть от регистра хоста")
+	}
+	if got := registry.byHost["rest.secure-proxy.lan"].transport.MaxIdleConnsPerHost; got != defaultUpstreamMaxIdleConnsPerHost {
+		t.Errorf("MaxIdleConnsPerHost = %d, want %d", got, defaultUpstreamMaxIdleConnsPerHost)
+	}
+
+	invalid := [][]UpstreamConfig{
+		{{Host: "rest.secure-proxy.lan", Destination: "backend:8000"}},
+		{{Host: "rest.secure-proxy.lan", Destination: "ftp://backend"}},
+		{
+			{Host: "rest.secure-proxy.lan", Destination: "http://a"},
+			{Host: "rest.secure-proxy.lan", Destination: "http://b"},
+		},
+	}
+	for _, configs := range invalid {
+		if _, err := buildUpstreamRegistry(configs); err == nil {
+			t.Errorf("buildUpstreamRegistry(%+v): ожидалась ошибка", configs)
+		}
+	}
+}
+
+func TestReloadUpstreamsUpdatesHosts(t *testing.T) {
+	loadTestUpstreams(t, []UpstreamConfig{
+		{Host: "rest.secure-proxy.lan", Destination: "http://127.0.0.1:1"},
+		{Host: "bar.restaurant.lan", Destination: "http://127.0.0.1:2"},
+	})
+
+	reloaded := []UpstreamConfig{
+		{Host: "kitchen.restaurant.lan", Destination: "http://127.0.0.1:3"},
+		{Host: "rest.secure-proxy.lan", Destination: "http://127.0.0.1:1"},
+	}
+	if err := reloadUpstreams(reloaded); err != nil {
+		t.Fatal(err)
+	}
+	// Ошибочная конфигурация не применяется ни к реестру, ни к списку хостов
+	if err := reloadUpstreams([]UpstreamConfig{{Host: "bar.restaurant.lan"}, {Host: "bar.restaurant.lan"}}); err == nil {
+		t.Fatal("ожидалась ошибка для повторного upstream")
+	}
+
+	tests := []struct {
+		name       string
+		host       string
+		wantLoaded bool
+	}{
+		{"добавленный хост", "kitchen.restaurant.lan", true},
+		{"оставшийся хост", "rest.secure-proxy.lan", true},
+		{"удаленный хост", "bar.restaurant.lan", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lookupUpstream(tt.host) != nil; got != tt.wantLoaded {
+				t.Errorf("upstream %s загружен = %v, want %v", tt.host, got, tt.wantLoaded)
+			}
+			if got := isSafeRedirectURL("https://" + tt.host + ":9443/"); got != tt.wantLoaded {
+				t.Errorf("перенаправление на %s разрешено = %v, want %v", tt.host, got, tt.wantLoaded)
+			}
+		})
+	}
+
+	if host := getDefaultProxyHost(); host != "kitchen.restaurant.lan" {
+		t.Errorf("хост по умолчанию %q, want первый upstream после перезагрузки", host)
+	}
+}
+
+func TestServeUpstreamEjectsFailingDestination(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	// Адрес закрытого сервера: соединение сразу отклоняется
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closedURL := closed.URL
+	closed.Close()
+
+	upstreams := []UpstreamConfig{{
+		Host:          "rest.secure-proxy.lan",
+		Destinations:  []DestinationConfig{{URL: closedURL}, {URL: backend.URL}},
+		LoadBalancing: LoadBalancingConfig{MaxFails: 1, EjectSeconds: 60},
+	}}
+	loadTestUpstreams(t, upstreams)
+
+	engine := gin.New()
+	engine.LoadHTMLGlob("templates/*")
+	engine.NoRoute(handlePublicProxy)
+
+	statuses := make(map[int]int)
+	for i := 0; i < 6; i++ {
+		recorder := closeNotifyRecorder{httptest.NewRecorder()}
+		engine.ServeHTTP(recorder, newBenchmarkRequest())
+		statuses[recorder.Code]++
+	}
+
+	// Первый запрос на закрытый адрес получает 502, после чего адрес исключается
+	if statuses[http.StatusBadGateway] != 1 || statuses[http.StatusOK] != 5 {
+		t.Errorf("статусы ответов %v, want один 502 и пять 200", statuses)
+	}
+
+	stats := GetUpstreamStats()
+	if len(stats) != 1 || len(stats[0].Destinations) != 2 {
+		t.Fatalf("stats = %+v", stats)
+	}
+	if failed := stats[0].Destinations[0]; !failed.Ejected || failed.Failures != 1 {
+		t.Errorf("закрытый адрес: %+v, want исключен после одной ошибки", failed)
+	}
+	if healthy := stats[0].Destinations[1]; healthy.Ejected || healthy.Requests != 5 {
+		t.Errorf("рабочий адрес: %+v", healthy)
+	}
+}
+
+func TestServeUpstreamCircuitBreaker(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closedURL := closed.URL
+	closed.Close()
+
+	upstreams := []UpstreamConfig{{
+		Host:           "rest.secure-proxy.lan",
+		Destination:    closedURL,
+		CircuitBreaker: CircuitBreakerConfig{FailureThreshold: 2, CooldownSeconds: 60},
+	}}
+	loadTestUpstreams(t, upstreams)
+
+	engine := gin.New()
+	engine.LoadHTMLGlob("templates/*")
+	engine.NoRoute(handlePublicProxy)
+
+	// Два сбоя подряд размыкают выключатель, браузер видит страницу ошибки
+	for i := 0; i < 2; i++ {
+		recorder := closeNotifyRecorder{httptest.NewRecorder()}
+		engine.ServeHTTP(recorder, newBenchmarkRequest())
+		if recorder.Code != http.StatusBadGateway || !strings.Contains(recorder.Body.String(), "<html>") {
+			t.Fatalf("запрос %d: статус %d, want 502 с HTML страницей", i+1, recorder.Code)
+		}
+	}
+
+	// Разомкнутый выключатель отвечает сразу, API клиент получает JSON
+	req := newBenchmarkRequest()
+	req.Header.Set("Accept", "application/json")
+	recorder := closeNotifyRecorder{httptest.NewRecorder()}
+	engine.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("статус %d, want 503", recorder.Code)
+	}
+	if !strings.Contains(recorder.Body.String(), `"detail"`) || recorder.Header().Get("Retry-After") == "" {
+		t.Errorf("ответ %q, Retry-After %q: want JSON ошибку с Retry-After", recorder.Body.String(), recorder.Header().Get("Retry-After"))
+	}
+
+	stats := GetUpstreamStats()
+	if stats[0].Circuit.State != circuitOpen || stats[0].Destinations[0].Requests != 2 {
+		t.Errorf("stats = %+v, want разомкнутый выключатель и 2 запроса к адресу", stats[0])
+	}
+}
+
+func TestServeUpstreamInterruptedResponse(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+	var requests atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) > 1 {
+			io.WriteString(w, "ok")
+			return
+		}
+		// Первый ответ обрывается посреди тела
+		w.Header().Set("Content-Length", "1000")
+		io.WriteString(w, "частично")
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer backend.Close()
+
+	upstreams := []UpstreamConfig{{
+		Host:           "rest.secure-proxy.lan",
+		Destination:    backend.URL,
+		LoadBalancing:  LoadBalancingConfig{Strategy: balanceLeastConnections},
+		CircuitBreaker: CircuitBreakerConfig{FailureThreshold: 1, CooldownSeconds: 60},
+	}}
+	loadTestUpstreams(t, upstreams)
+	// Обрывается пробный запрос полуоткрытого выключателя
+	lookupUpstream("rest.secure-proxy.lan").breaker.state = circuitHalfOpen
+
+	// ReverseProxy паникует при обрыве тела только под настоящим http.Server
+	engine := gin.New()
+	engine.LoadHTMLGlob("templates/*")
+	engine.NoRoute(handlePublicProxy)
+	proxy := httptest.NewServer(engine)
+	defer proxy.Close()
+
+	get := func() (int, string, error) {
+		req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/passenger/menu", nil)
+		req.Host = "rest.secure-proxy.lan"
+		resp, err := proxy.Client().Do(req)
+		if err != nil {
+			return 0, "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body), err
+	}
+
+	if _, _, err := get(); err == nil {
+		t.Fatal("первый ответ дочитан без ошибки, want обрыв тела")
+	}
+	stats := GetUpstreamStats()[0]
+	if stats.Destinations[0].ActiveRequests != 0 {
+		t.Errorf("активных запросов после обрыва: %d, want 0", stats.Destinations[0].ActiveRequests)
+	}
+
+	// Пробный запрос освобожден, следующий запрос проходит и замыкает выключатель
+	status, body, err := get()
+	if err != nil || status != http.StatusOK || body != "ok" {
+		t.Fatalf("второй запрос: %d %q %v, want 200 ok", status, body, err)
+	}
+	if state := GetUpstreamStats()[0].Circuit.State; state != circuitClosed {
+		t.Errorf("состояние выключателя %q, want %q", state, circuitClosed)
+	}
+}
@@ -0,0 +1,75 @@
+// Package main - проверка адресов перенаправления после входа.
+// Разрешает перенаправление только на хосты прокси, чтобы ссылка на вход не уводила на сторонний сайт.
+package main
+
+import (
+	"log"
+	"net/url"
+	"strings"
+)
+
+// isAllowedRedirectHost проверяет, что хост принадлежит прокси: upstream, хост по умолчанию или домен cookie
+func isAllowedRedirectHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" {
+		return false
+	}
+
+	if host == strings.ToLower(getDefaultProxyHost()) {
+		return true
+	}
+
+	if config == nil {
+		return false
+	}
+
+	for _, upstream := range getUpstreamConfigs() {
+		if host == strings.ToLower(upstream.Host) {
+			return true
+		}
+	}
+
+	cookieDomain := strings.ToLower(strings.TrimPrefix(config.Sessions.CookieDomain, "."))
+	if cookieDomain != "" && (host == cookieDomain || strings.HasSuffix(host, "."+cookieDomain)) {
+		return true
+	}
+
+	return false
+}
+
+// isSafeRedirectURL проверяет адрес перенаправления.
+// Разрешены относительные пути текущего хоста и абсолютные http(s) адреса разрешенных хостов.
+func isSafeRedirectURL(rawURL string) bool {
+	if rawURL == "" || strings.ContainsAny(rawURL, "\\\r\n\t") {
+		return false
+	}
+
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+
+	if target.Scheme == "" && target.Host == "" {
+		// "//evil.com" браузер трактует как абсолютный адрес, поэтому он сюда не попадает
+		return strings.HasPrefix(rawURL, "/") && !strings.HasPrefix(rawURL, "//")
+	}
+
+	if target.Scheme != "https" && target.Scheme != "http" {
+		return false
+	}
+	if target.User != nil {
+		return false
+	}
+
+	return isAllowedRedirectHost(target.Hostname())
+}
+
+// safeRedirectURL возвращает адрес перенаправления или dashboard, если адрес не прошел проверку
+func safeRedirectURL(rawURL string) string {
+	if isSafeRedirectURL(rawURL) {
+		return rawURL
+	}
+
+	log.Printf("Отклонен небезопасный адрес перенаправления: %q", rawURL)
+	return getDashboardURL()
+}
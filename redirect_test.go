@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestIsSafeRedirectURL(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+
+	config = &Config{
+		Proxy:     ProxyConfig{DefaultHost: "rest.secure-proxy.lan", Port: 9443},
+		Sessions:  SessionsConfig{CookieDomain: ".secure-proxy.lan"},
+		Upstreams: []UpstreamConfig{{Host: "kitchen.restaurant.lan", Destination: "http://backend:8000"}},
+	}
+
+	tests := []struct {
+		name string
+		url  string
+		want bool
+	}{
+		{"хост по умолчанию", "https://rest.secure-proxy.lan:9443/waiter", true},
+		{"upstream хост", "https://kitchen.restaurant.lan:9443/", true},
+		{"поддомен домена cookie", "https://auth.secure-proxy.lan:8443/admin", true},
+		{"хост в другом регистре", "https://REST.secure-proxy.lan/", true},
+		{"относительный путь", "/admin", true},
+		{"сторонний хост", "https://evil.example.com/", false},
+		{"суффикс без точки", "https://evilsecure-proxy.lan/", false},
+		{"домен cookie как поддомен чужого", "https://secure-proxy.lan.evil.com/", false},
+		{"адрес без схемы", "//evil.example.com/", false},
+		{"обратный слеш", "/\\evil.example.com", false},
+		{"javascript", "javascript:alert(1)", false},
+		{"учетные данные в адресе", "https://rest.secure-proxy.lan@evil.example.com/", false},
+		{"пустой адрес", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isSafeRedirectURL(tt.url); got != tt.want {
+				t.Errorf("isSafeRedirectURL(%q) = %v, want %v", tt.url, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+// Package main - повтор запросов к upstream после сбоя.
+// Повторяются только безопасные запросы (GET, HEAD, OPTIONS) и запросы с заголовком Idempotency-Key;
+// число повторов ограничено бюджетом, чтобы повторы не добивали перегруженный сервис.
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultRetryBackoffMilliseconds    = 50
+	defaultRetryMaxBackoffMilliseconds = 1000
+	defaultRetryBudgetPercent          = 20
+	defaultRetryBudgetMinRetries       = 10
+
+	// Окно, за которое считается бюджет повторов
+	retryBudgetWindow = 10 * time.Second
+	// Тело запроса буферизуется для повтора, только если оно не больше этого размера
+	retryBodyLimit = 1 << 20
+
+	idempotencyKeyHeader = "Idempotency-Key"
+)
+
+// errRetryableStatus возвращается из ModifyResponse, чтобы ответ 502/503/504 не ушел клиенту, а запрос повторился
+var errRetryableStatus = errors.New("ответ upstream будет повторен")
+
+// retryPolicy - настройки повторов upstream с подставленными значениями по умолчанию
+type retryPolicy struct {
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	budget     *retryBudget
+}
+
+func newRetryPolicy(cfg RetryConfig) *retryPolicy {
+	return &retryPolicy{
+		attempts:   cfg.Attempts,
+		backoff:    time.Duration(intOrDefault(cfg.BackoffMilliseconds, defaultRetryBackoffMilliseconds)) * time.Millisecond,
+		maxBackoff: time.Duration(intOrDefault(cfg.MaxBackoffMilliseconds, defaultRetryMaxBackoffMilliseconds)) * time.Millisecond,
+		budget: &retryBudget{
+			percent:    intOrDefault(cfg.BudgetPercent, defaultRetryBudgetPercent),
+			minRetries: intOrDefault(cfg.BudgetMinRetries, defaultRetryBudgetMinRetries),
+		},
+	}
+}
+
+// isRetryableRequest сообщает, можно ли отправить запрос повторно без риска выполнить действие дважды.
+// Неидемпотентные запросы (например, создание заказа) повторяются только с Idempotency-Key.
+func isRetryableRequest(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return req.Header.Get(idempotencyKeyHeader) != ""
+}
+
+// bufferRetryBody читает тело запроса в память, чтобы отправить его повторно.
+// Слишком большое тело остается потоком, и запрос не повторяется.
+func bufferRetryBody(req *http.Request) ([]byte, bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true
+	}
+	if req.ContentLength > retryBodyLimit {
+		return nil, false
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, retryBodyLimit+1))
+	if err != nil || len(body) > retryBodyLimit {
+		req.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), req.Body))
+		return nil, false
+	}
+	return body, true
+}
+
+// delay возвращает паузу перед повтором номер retry (с 1): та же экспонента, что и задержка входа
+func (p *retryPolicy) delay(retry int) time.Duration {
+	return loginBackoffDelay(int64(retry), p.backoff, p.maxBackoff)
+}
+
+// waitRetry выдерживает паузу перед повтором. Возвращает false, если клиент отключился.
+func waitRetry(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// retryBudget ограничивает долю повторов от числа запросов upstream за окно.
+// Небольшой минимум повторов доступен всегда, чтобы редкие запросы тоже могли повторяться.
+type retryBudget struct {
+	percent    int
+	minRetries int
+
+	mu          sync.Mutex
+	windowStart time.Time
+	requests    int
+	retries     int
+
+	total atomic.Uint64
+}
+
+func (b *retryBudget) resetWindow(now time.Time) {
+	if now.Sub(b.windowStart) >= retryBudgetWindow {
+		b.windowStart = now
+		b.requests = 0
+		b.retries = 0
+	}
+}
+
+// recordRequest учитывает исходный запрос (не повтор)
+func (b *retryBudget) recordRequest(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.resetWindow(now)
+	b.requests++
+}
+
+// withdraw расходует бюджет на один повтор. Возвращает false, если бюджет исчерпан.
+func (b *retryBudget) withdraw(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.resetWindow(now)
+
+	if b.retries >= b.minRetries+b.requests*b.percent/100 {
+		return false
+	}
+	b.retries++
+	b.total.Add(1)
+	return true
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestIsRetryableRequest(t *testing.T) {
+	tests := []struct {
+		name           string
+		method         string
+		idempotencyKey string
+		want           bool
+	}{
+		{"GET", http.MethodGet, "", true},
+		{"HEAD", http.MethodHead, "", true},
+		{"OPTIONS", http.MethodOptions, "", true},
+		{"POST без ключа", http.MethodPost, "", false},
+		{"PUT без ключа", http.MethodPut, "", false},
+		{"POST с ключом", http.MethodPost, "order-42", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "http://rest.secure-proxy.lan/orders", nil)
+			if tt.idempotencyKey != "" {
+				req.Header.Set(idempotencyKeyHeader, tt.idempotencyKey)
+			}
+			if got := isRetryableRequest(req); got != tt.want {
+				t.Errorf("isRetryableRequest() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	budget := &retryBudget{percent: 20, minRetries: 1}
+	now := time.Now()
+
+	for i := 0; i < 10; i++ {
+		budget.recordRequest(now)
+	}
+	// 1 повтор минимума + 20% от 10 запросов
+	for i := 0; i < 3; i++ {
+		if !budget.withdraw(now) {
+			t.Fatalf("повтор %d отклонен, бюджет 3", i+1)
+		}
+	}
+	if budget.withdraw(now) {
+		t.Fatal("повтор сверх бюджета должен быть отклонен")
+	}
+
+	// В новом окне доступен минимум
+	if !budget.withdraw(now.Add(retryBudgetWindow)) {
+		t.Error("в новом окне бюджет должен восстановиться")
+	}
+}
+
+func TestServeUpstreamRetries(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	var failingHits, healthyHits atomic.Int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failingHits.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	var lastBody string
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		healthyHits.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		lastBody = string(body)
+		io.WriteString(w, "ok")
+	}))
+	defer healthy.Close()
+
+	upstreams := []UpstreamConfig{{
+		Host:          "rest.secure-proxy.lan",
+		Destinations:  []DestinationConfig{{URL: failing.URL}, {URL: healthy.URL}},
+		LoadBalancing: LoadBalancingConfig{MaxFails: 100},
+		Retry:         RetryConfig{Attempts: 1, BackoffMilliseconds: 1},
+	}}
+	loadTestUpstreams(t, upstreams)
+
+	engine := gin.New()
+	engine.LoadHTMLGlob("templates/*")
+	engine.NoRoute(handlePublicProxy)
+
+	serve := func(method, idempotencyKey string) int {
+		req := httptest.NewRequest(method, "http://rest.secure-proxy.lan/orders", strings.NewReader(`{"table":7}`))
+		req.Host = "rest.secure-proxy.lan"
+		if idempotencyKey != "" {
+			req.Header.Set(idempotencyKeyHeader, idempotencyKey)
+		}
+		recorder := closeNotifyRecorder{httptest.NewRecorder()}
+		engine.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	// GET повторяется на другом адресе, какой бы адрес ни был выбран первым
+	for i := 0; i < 2; i++ {
+		if code := serve(http.MethodGet, ""); code != http.StatusOK {
+			t.Fatalf("GET: статус %d, want 200 после повтора", code)
+		}
+	}
+	if failingHits.Load() != 1 || healthyHits.Load() != 2 {
+		t.Errorf("обращения к адресам: сбойный %d, рабочий %d; want 1 и 2", failingHits.Load(), healthyHits.Load())
+	}
+
+	// Создание заказа без ключа идемпотентности не повторяется
+	failingHits.Store(0)
+	healthyHits.Store(0)
+	statuses := make(map[int]int)
+	for i := 0; i < 2; i++ {
+		statuses[serve(http.MethodPost, "")]++
+	}
+	if statuses[http.StatusServiceUnavailable] != 1 || failingHits.Load()+healthyHits.Load() != 2 {
+		t.Errorf("POST без ключа: статусы %v, обращений %d; want один 503 и без повторов",
+			statuses, failingHits.Load()+healthyHits.Load())
+	}
+
+	// С ключом запрос повторяется вместе с телом
+	failingHits.Store(0)
+	for i := 0; i < 2; i++ {
+		if code := serve(http.MethodPost, "order-42"); code != http.StatusOK {
+			t.Fatalf("POST с ключом: статус %d, want 200 после повтора", code)
+		}
+	}
+	if lastBody != `{"table":7}` {
+		t.Errorf("тело повтора %q, want исходное", lastBody)
+	}
+
+	// Повтор - после каждого обращения к сбойному адресу: одно для GET и сколько пришлось на POST с ключом
+	if stats := GetUpstreamStats(); stats[0].Retries != uint64(1+failingHits.Load()) {
+		t.Errorf("Retries = %d, want %d", stats[0].Retries, 1+failingHits.Load())
+	}
+}
@@ -0,0 +1,189 @@
+// Package main - преобразование путей запросов к upstream.
+// Путь клиента проходит удаление префикса, замены по регулярным выражениям, добавление префикса
+// и базовый путь адреса upstream; в ответе Location и Path в Set-Cookie переводятся обратно.
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// setCookiePathPattern находит атрибут Path в заголовке Set-Cookie
+var setCookiePathPattern = regexp.MustCompile(`(?i)(;\s*path=)([^;]*)`)
+
+// regexRewrite - замена пути по регулярному выражению
+type regexRewrite struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// pathRewriter - правила преобразования путей одного upstream
+type pathRewriter struct {
+	stripPrefix string
+	addPrefix   string
+	rules       []regexRewrite
+}
+
+// normalizePathPrefix приводит префикс к виду "/prefix" без завершающей косой черты
+func normalizePathPrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return ""
+	}
+	return "/" + prefix
+}
+
+func newPathRewriter(cfg UpstreamRewriteConfig) (*pathRewriter, error) {
+	rewriter := &pathRewriter{
+		stripPrefix: normalizePathPrefix(cfg.StripPrefix),
+		addPrefix:   normalizePathPrefix(cfg.AddPrefix),
+	}
+
+	for _, rule := range cfg.Regex {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("неверное выражение rewrite.regex %q: %v", rule.Pattern, err)
+		}
+		rewriter.rules = append(rewriter.rules, regexRewrite{pattern: pattern, replacement: rule.Replacement})
+	}
+	return rewriter, nil
+}
+
+// hasPathPrefix проверяет префикс по границе сегмента: /api подходит к /api/x, но не к /apix
+func hasPathPrefix(path, prefix string) bool {
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// joinPath присоединяет путь к префиксу
+func joinPath(prefix, path string) string {
+	if prefix == "" {
+		return path
+	}
+	return prefix + path
+}
+
+// trimPathPrefix удаляет префикс, оставляя путь абсолютным
+func trimPathPrefix(path, prefix string) string {
+	path = strings.TrimPrefix(path, prefix)
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+// upstreamPrefix - часть пути, которую добавляет прокси: базовый путь адреса и addPrefix
+func (r *pathRewriter) upstreamPrefix(basePath string) string {
+	return normalizePathPrefix(joinPath(normalizePathPrefix(basePath), r.addPrefix))
+}
+
+// upstreamPath переводит путь клиента в путь запроса к адресу с базовым путем basePath
+func (r *pathRewriter) upstreamPath(path, basePath string) string {
+	if r.stripPrefix != "" && hasPathPrefix(path, r.stripPrefix) {
+		path = trimPathPrefix(path, r.stripPrefix)
+	}
+
+	// Применяется первое подходящее выражение
+	for _, rule := range r.rules {
+		if rule.pattern.MatchString(path) {
+			path = rule.pattern.ReplaceAllString(path, rule.replacement)
+			if !strings.HasPrefix(path, "/") {
+				path = "/" + path
+			}
+			break
+		}
+	}
+
+	return joinPath(r.upstreamPrefix(basePath), path)
+}
+
+// clientPath переводит путь upstream обратно в путь клиента.
+// Обратимы только префиксы: замены по регулярным выражениям не отменяются.
+func (r *pathRewriter) clientPath(path, basePath string) string {
+	prefix := r.upstreamPrefix(basePath)
+	if prefix == r.stripPrefix || !hasPathPrefix(path, prefix) {
+		return path
+	}
+
+	// Сам префикс без косой черты переводится так же, без нее: Path=/api -> Path=/kitchen
+	if path == prefix && r.stripPrefix != "" {
+		return r.stripPrefix
+	}
+	return joinPath(r.stripPrefix, trimPathPrefix(path, prefix))
+}
+
+// rewriteRequest задает путь исходящего запроса по пути клиента и адресу upstream.
+// Те же преобразования применяются к закодированному пути, чтобы сохранить исходное
+// кодирование, например %2F внутри сегмента; если результаты расходятся, путь кодируется заново.
+func (r *pathRewriter) rewriteRequest(out, in, target *url.URL) {
+	out.Path = r.upstreamPath(in.Path, target.Path)
+	out.RawPath = ""
+	rawPath := r.upstreamPath(in.EscapedPath(), target.EscapedPath())
+	if unescaped, err := url.PathUnescape(rawPath); err == nil && unescaped == out.Path {
+		out.RawPath = rawPath
+	}
+}
+
+// proxyAuthority возвращает адрес прокси для хоста без порта: порт прокси указывается, если он не 443
+func proxyAuthority(host string) string {
+	if port := getProxyPort(); port != 443 {
+		return net.JoinHostPort(host, strconv.Itoa(port))
+	}
+	return host
+}
+
+// rewriteLocation переводит редирект upstream в адрес прокси host (хост с портом, см. proxyAuthority).
+// Абсолютный адрес самого upstream заменяется адресом прокси, внешние адреса не меняются.
+func (r *pathRewriter) rewriteLocation(location string, target *url.URL, host string) string {
+	loc, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+
+	if loc.IsAbs() || loc.Host != "" {
+		hostname := (&url.URL{Host: host}).Hostname()
+		if !strings.EqualFold(loc.Host, target.Host) && !strings.EqualFold(loc.Hostname(), hostname) {
+			return location
+		}
+		loc.Scheme = "https"
+		loc.Host = host
+	} else if !strings.HasPrefix(loc.Path, "/") {
+		// Относительный путь разрешается браузером от текущего адреса и уже указывает на прокси
+		return location
+	}
+
+	loc.Path = r.clientPath(loc.Path, target.Path)
+	loc.RawPath = ""
+	return loc.String()
+}
+
+// rewriteSetCookiePath переводит атрибут Path в заголовке Set-Cookie в путь клиента
+func (r *pathRewriter) rewriteSetCookiePath(setCookie string, target *url.URL) string {
+	return setCookiePathPattern.ReplaceAllStringFunc(setCookie, func(attribute string) string {
+		parts := setCookiePathPattern.FindStringSubmatch(attribute)
+		path := strings.TrimSpace(parts[2])
+		if !strings.HasPrefix(path, "/") {
+			return attribute
+		}
+		return parts[1] + r.clientPath(path, target.Path)
+	})
+}
+
+// rewriteResponse переводит Location и пути cookie ответа upstream в пути клиента
+func (r *pathRewriter) rewriteResponse(resp *http.Response, target *url.URL, host string) {
+	if location := resp.Header.Get("Location"); location != "" {
+		resp.Header.Set("Location", r.rewriteLocation(location, target, host))
+	}
+
+	if r.upstreamPrefix(target.Path) == r.stripPrefix {
+		return
+	}
+	cookies := resp.Header.Values("Set-Cookie")
+	for i, cookie := range cookies {
+		cookies[i] = r.rewriteSetCookiePath(cookie, target)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestPathRewriterUpstreamPath(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      UpstreamRewriteConfig
+		basePath string
+		path     string
+		want     string
+	}{
+		{"без правил", UpstreamRewriteConfig{}, "", "/orders/7", "/orders/7"},
+		{"базовый путь destination", UpstreamRewriteConfig{}, "/api", "/orders/7", "/api/orders/7"},
+		{"базовый путь с косой чертой", UpstreamRewriteConfig{}, "/api/", "/", "/api/"},
+		{"удаление префикса", UpstreamRewriteConfig{StripPrefix: "/kitchen"}, "", "/kitchen/orders", "/orders"},
+		{"удаление всего пути", UpstreamRewriteConfig{StripPrefix: "/kitchen/"}, "", "/kitchen", "/"},
+		{"префикс не по границе сегмента", UpstreamRewriteConfig{StripPrefix: "/kitchen"}, "", "/kitchenware", "/kitchenware"},
+		{"добавление префикса", UpstreamRewriteConfig{AddPrefix: "v2"}, "/api", "/menu", "/api/v2/menu"},
+		{
+			"замена по выражению",
+			UpstreamRewriteConfig{Regex: []RegexRewriteConfig{
+				{Pattern: `^/orders/(\d+)$`, Replacement: "/order?id=$1"},
+				{Pattern: `^/orders`, Replacement: "/unused"},
+			}},
+			"", "/orders/7", "/order?id=7",
+		},
+		{
+			"все правила вместе",
+			UpstreamRewriteConfig{StripPrefix: "/kitchen", AddPrefix: "/internal", Regex: []RegexRewriteConfig{
+				{Pattern: `^/tickets`, Replacement: "/orders"},
+			}},
+			"/api", "/kitchen/tickets/3", "/api/internal/orders/3",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rewriter, err := newPathRewriter(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rewriter.upstreamPath(tt.path, tt.basePath); got != tt.want {
+				t.Errorf("upstreamPath(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+
+	if _, err := newPathRewriter(UpstreamRewriteConfig{Regex: []RegexRewriteConfig{{Pattern: "("}}}); err == nil {
+		t.Error("ожидалась ошибка для неверного выражения")
+	}
+}
+
+func TestPathRewriterRequest(t *testing.T) {
+	tests := []struct {
+		name        string
+		cfg         UpstreamRewriteConfig
+		destination string
+		path        string
+		want        string
+	}{
+		{"без изменений", UpstreamRewriteConfig{}, "http://backend:8000", "/files/a%2Fb", "/files/a%2Fb"},
+		{"удаление префикса", UpstreamRewriteConfig{StripPrefix: "/kitchen"}, "http://backend:8000", "/kitchen/files/a%2Fb", "/files/a%2Fb"},
+		{"базовый путь и префикс", UpstreamRewriteConfig{AddPrefix: "/v2"}, "http://backend:8000/api", "/files/a%2Fb", "/api/v2/files/a%2Fb"},
+		{"пробел кодируется заново", UpstreamRewriteConfig{StripPrefix: "/kitchen"}, "http://backend:8000", "/kitchen/menu%20day", "/menu%20day"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rewriter, err := newPathRewriter(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			target, _ := url.Parse(tt.destination)
+			in, _ := url.Parse("https://rest.secure-proxy.lan" + tt.path)
+			out := *target
+			rewriter.rewriteRequest(&out, in, target)
+			if got := out.EscapedPath(); got != tt.want {
+				t.Errorf("rewriteRequest(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPathRewriterResponse(t *testing.T) {
+	rewriter, err := newPathRewriter(UpstreamRewriteConfig{StripPrefix: "/kitchen"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, _ := url.Parse("http://backend:8000/api")
+	host := "rest.secure-proxy.lan:9443"
+
+	locations := []struct {
+		name     string
+		location string
+		want     string
+	}{
+		{"абсолютный адрес upstream", "http://backend:8000/api/orders/7", "https://rest.secure-proxy.lan:9443/kitchen/orders/7"},
+		{"адрес прокси с портом", "https://rest.secure-proxy.lan:9443/api/orders/7", "https://rest.secure-proxy.lan:9443/kitchen/orders/7"},
+		{"адрес прокси без порта", "https://rest.secure-proxy.lan/api/orders/7", "https://rest.secure-proxy.lan:9443/kitchen/orders/7"},
+		{"путь upstream", "/api/login?next=%2F", "/kitchen/login?next=%2F"},
+		{"путь вне базового", "/static/logo.png", "/static/logo.png"},
+		{"внешний адрес", "https://pay.example.com/api/checkout", "https://pay.example.com/api/checkout"},
+		{"относительный путь", "orders/7", "orders/7"},
+	}
+	for _, tt := range locations {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rewriter.rewriteLocation(tt.location, target, host); got != tt.want {
+				t.Errorf("rewriteLocation(%q) = %q, want %q", tt.location, got, tt.want)
+			}
+		})
+	}
+
+	resp := &http.Response{Header: http.Header{}}
+	resp.Header.Add("Set-Cookie", "session=1; Path=/api/orders; HttpOnly")
+	resp.Header.Add("Set-Cookie", "theme=dark; path=/api")
+	resp.Header.Add("Set-Cookie", "lang=ru; Path=/")
+	rewriter.rewriteResponse(resp, target, host)
+
+	want := []string{
+		"session=1; Path=/kitchen/orders; HttpOnly",
+		"theme=dark; path=/kitchen",
+		"lang=ru; Path=/",
+	}
+	for i, cookie := range resp.Header.Values("Set-Cookie") {
+		if cookie != want[i] {
+			t.Errorf("Set-Cookie[%d] = %q, want %q", i, cookie, want[i])
+		}
+	}
+}
+
+func TestProxyAuthority(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+
+	tests := []struct {
+		name string
+		port int
+		want string
+	}{
+		{"порт по умолчанию", 0, "rest.secure-proxy.lan:9443"},
+		{"стандартный порт HTTPS", 443, "rest.secure-proxy.lan"},
+		{"другой порт", 8443, "rest.secure-proxy.lan:8443"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = &Config{Proxy: ProxyConfig{Port: tt.port}}
+			if got := proxyAuthority("rest.secure-proxy.lan"); got != tt.want {
+				t.Errorf("proxyAuthority() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeUpstreamKeepsDestinationBasePath(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+	var gotPath string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.RequestURI()
+		http.Redirect(w, r, "/api/orders", http.StatusFound)
+	}))
+	defer backend.Close()
+
+	upstreams := []UpstreamConfig{{
+		Host:        "rest.secure-proxy.lan",
+		Destination: backend.URL + "/api",
+		Rewrite:     UpstreamRewriteConfig{StripPrefix: "/passenger"},
+	}}
+	loadTestUpstreams(t, upstreams)
+
+	engine := gin.New()
+	engine.NoRoute(handlePublicProxy)
+	req := httptest.NewRequest(http.MethodGet, "http://rest.secure-proxy.lan/passenger/menu?lang=ru", nil)
+	req.Host = "rest.secure-proxy.lan"
+	recorder := closeNotifyRecorder{httptest.NewRecorder()}
+	engine.ServeHTTP(recorder, req)
+	io.Copy(io.Discard, recorder.Body)
+
+	if gotPath != "/api/menu?lang=ru" {
+		t.Errorf("upstream получил %q, want /api/menu?lang=ru", gotPath)
+	}
+	if location := recorder.Header().Get("Location"); location != "/passenger/orders" {
+		t.Errorf("Location = %q, want /passenger/orders", location)
+	}
+}
@@ -4,15 +4,31 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"log"
 	"strings"
+
+	"github.com/valkey-io/valkey-go"
 )
 
-// Структура для хранения пользователя в Valkey
+// Структура для хранения пользователя в Valkey.
+// При настроенных ключах шифрования секрет хранится в EncryptedTOTP, а TOTPSecret
+// заполняется только в памяти после расшифровки. Открытый TOTPSecret в Valkey остается
+// лишь у старых записей до их ленивой миграции.
 type ValkeyUser struct {
-	TOTPSecret string   `json:"totpSecret"`
-	Roles      []string `json:"roles"`
+	TOTPSecret    string           `json:"totpSecret,omitempty"`
+	EncryptedTOTP *EncryptedSecret `json:"encryptedTotp,omitempty"`
+	Roles         []string         `json:"roles"`
 }
 
+// replaceUserRecordScript перезаписывает запись пользователя, только если она не изменилась с момента чтения
+var replaceUserRecordScript = valkey.NewLuaScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	redis.call('SET', KEYS[1], ARGV[2])
+	return 1
+end
+return 0
+`)
+
 // Ключи для хранения в Valkey
 const (
 	userKeyPrefix         = "user:"
@@ -40,21 +56,19 @@ func SaveUser(username string, totpSecret string, roles []string) error {
 	ctx := context.Background()
 	userKey := getUserKey(username)
 
-	user := ValkeyUser{
-		TOTPSecret: totpSecret,
-		Roles:      roles,
-	}
-
-	userJSON, err := json.Marshal(user)
+	userJSON, err := encodeUserRecord(userKey, totpSecret, roles)
 	if err != nil {
-		return fmt.Errorf("ошибка сериализации пользователя: %v", err)
+		return err
 	}
 
 	// Сохраняем данные пользователя
-	err = valkeyClient.Do(ctx, valkeyClient.B().Set().Key(userKey).Value(string(userJSON)).Build()).Error()
+	err = valkeyClient.Do(ctx, valkeyClient.B().Set().Key(userKey).Value(userJSON).Build()).Error()
 	if err != nil {
 		return fmt.Errorf("ошибка сохранения пользователя: %v", err)
 	}
+	if err := addToIndex(ctx, usersIndexKey, username); err != nil {
+		return fmt.Errorf("ошибка обновления индекса пользователей: %v", err)
+	}
 
 	// Сохраняем роли пользователя в отдельный Set для быстрого доступа
 	userRolesKey := getUserRolesKey(username)
@@ -84,57 +98,218 @@ func GetUser(username string) (*ValkeyUser, error) {
 		return nil, fmt.Errorf("пользователь не найден: %v", err)
 	}
 
+	return loadUserRecord(username, userJSON)
+}
+
+// loadUserRecord расшифровывает прочитанную запись пользователя
+func loadUserRecord(username, userJSON string) (*ValkeyUser, error) {
+	userKey := getUserKey(username)
+	user, err := decodeUserRecord(userKey, userJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	// Ленивая миграция: открытый секрет или секрет под старым ключом перешифровываем активным ключом
+	if needsReencryption(user) {
+		if _, err := reencryptUserRecord(userKey, userJSON, user); err != nil {
+			log.Printf("Не удалось перешифровать секрет пользователя %s: %v", username, err)
+		}
+	}
+
+	user.EncryptedTOTP = nil
+	return user, nil
+}
+
+// encodeUserRecord сериализует пользователя, шифруя TOTP секрет при настроенных ключах
+func encodeUserRecord(userKey, totpSecret string, roles []string) (string, error) {
+	user := ValkeyUser{
+		TOTPSecret: totpSecret,
+		Roles:      roles,
+	}
+
+	if totpKeyring != nil && totpSecret != "" {
+		encrypted, err := totpKeyring.Encrypt(totpSecret, userKey)
+		if err != nil {
+			return "", fmt.Errorf("ошибка шифрования TOTP секрета: %v", err)
+		}
+		user.TOTPSecret = ""
+		user.EncryptedTOTP = encrypted
+	}
+
+	userJSON, err := json.Marshal(user)
+	if err != nil {
+		return "", fmt.Errorf("ошибка сериализации пользователя: %v", err)
+	}
+	return string(userJSON), nil
+}
+
+// decodeUserRecord десериализует пользователя и расшифровывает TOTP секрет
+func decodeUserRecord(userKey, userJSON string) (*ValkeyUser, error) {
 	var user ValkeyUser
-	err = json.Unmarshal([]byte(userJSON), &user)
+	err := json.Unmarshal([]byte(userJSON), &user)
 	if err != nil {
 		return nil, fmt.Errorf("ошибка десериализации пользователя: %v", err)
 	}
 
+	if user.EncryptedTOTP != nil {
+		if totpKeyring == nil {
+			return nil, fmt.Errorf("TOTP секрет зашифрован, но ключи шифрования не настроены")
+		}
+		secret, err := totpKeyring.Decrypt(user.EncryptedTOTP, userKey)
+		if err != nil {
+			return nil, err
+		}
+		user.TOTPSecret = secret
+	}
+
 	return &user, nil
 }
 
+// needsReencryption проверяет, хранится ли секрет открытым текстом или под неактивным ключом
+func needsReencryption(user *ValkeyUser) bool {
+	if totpKeyring == nil || user.TOTPSecret == "" {
+		return false
+	}
+	return user.EncryptedTOTP == nil || user.EncryptedTOTP.KeyID != totpKeyring.ActiveKeyID()
+}
+
+// reencryptUserRecord перезаписывает секрет активным ключом, если запись не изменилась с момента чтения
+func reencryptUserRecord(userKey, oldJSON string, user *ValkeyUser) (bool, error) {
+	newJSON, err := encodeUserRecord(userKey, user.TOTPSecret, user.Roles)
+	if err != nil {
+		return false, err
+	}
+
+	ctx := context.Background()
+	replaced, err := replaceUserRecordScript.Exec(ctx, valkeyClient, []string{userKey}, []string{oldJSON, newJSON}).AsInt64()
+	if err != nil {
+		return false, fmt.Errorf("ошибка сохранения пользователя: %v", err)
+	}
+	return replaced == 1, nil
+}
+
+// ReencryptAllUsers перешифровывает секреты всех пользователей активным ключом.
+// Используется при ротации ключей, чтобы старый ключ можно было удалить из набора.
+func ReencryptAllUsers() (int, error) {
+	if totpKeyring == nil {
+		return 0, fmt.Errorf("ключи шифрования не настроены (TOTP_KEYS или TOTP_KEYS_FILE)")
+	}
+
+	usernames, err := getAllUsernames()
+	if err != nil {
+		return 0, err
+	}
+
+	ctx := context.Background()
+	reencrypted := 0
+	for _, username := range usernames {
+		userKey := getUserKey(username)
+		userJSON, err := valkeyClient.Do(ctx, valkeyClient.B().Get().Key(userKey).Build()).ToString()
+		if err != nil {
+			continue
+		}
+
+		user, err := decodeUserRecord(userKey, userJSON)
+		if err != nil {
+			return reencrypted, fmt.Errorf("пользователь %s: %v", username, err)
+		}
+		if !needsReencryption(user) {
+			continue
+		}
+
+		replaced, err := reencryptUserRecord(userKey, userJSON, user)
+		if err != nil {
+			return reencrypted, fmt.Errorf("пользователь %s: %v", username, err)
+		}
+		if replaced {
+			reencrypted++
+		}
+	}
+
+	return reencrypted, nil
+}
+
+// UserExists проверяет, существует ли пользователь в Valkey
+func UserExists(username string) (bool, error) {
+	ctx := context.Background()
+	exists, err := valkeyClient.Do(ctx, valkeyClient.B().Exists().Key(getUserKey(username)).Build()).AsInt64()
+	if err != nil {
+		return false, fmt.Errorf("ошибка проверки пользователя: %v", err)
+	}
+	return exists == 1, nil
+}
+
 // DeleteUser удаляет пользователя из Valkey
 func DeleteUser(username string) error {
 	ctx := context.Background()
 	userKey := getUserKey(username)
 	userRolesKey := getUserRolesKey(username)
 
-	// Удаляем данные пользователя и его роли
+	// Удаляем данные пользователя, его роли и служебные ключи TOTP
 	valkeyClient.Do(ctx, valkeyClient.B().Del().Key(userKey).Build())
 	valkeyClient.Do(ctx, valkeyClient.B().Del().Key(userRolesKey).Build())
+	valkeyClient.Do(ctx, valkeyClient.B().Del().Key(getUserTOTPLastStepKey(username)).Build())
+	valkeyClient.Do(ctx, valkeyClient.B().Del().Key(getUserTOTPQRPendingKey(username)).Build())
+	removeFromIndex(ctx, usersIndexKey, username)
 
 	return nil
 }
 
 // GetAllUsers получает всех пользователей из Valkey
 func GetAllUsers() (map[string]*ValkeyUser, error) {
-	ctx := context.Background()
 	users := make(map[string]*ValkeyUser)
 
-	// Получаем все ключи пользователей
-	keysResult := valkeyClient.Do(ctx, valkeyClient.B().Keys().Pattern(userKeyPrefix+"*").Build())
-	keys, err := keysResult.AsStrSlice()
-	if err != nil {
-		return nil, fmt.Errorf("ошибка получения ключей: %v", err)
+	usernames, err := getAllUsernames()
+	if err != nil || len(usernames) == 0 {
+		return users, err
 	}
 
-	for _, key := range keys {
-		username := strings.TrimPrefix(key, userKeyPrefix)
-		user, err := GetUser(username)
+	// Читаем все записи одним конвейером вместо запроса на каждого пользователя
+	ctx := context.Background()
+	cmds := make(valkey.Commands, 0, len(usernames))
+	for _, username := range usernames {
+		cmds = append(cmds, valkeyClient.B().Get().Key(getUserKey(username)).Build())
+	}
+
+	var missing []string
+	for i, result := range valkeyClient.DoMulti(ctx, cmds...) {
+		userJSON, err := result.ToString()
+		if valkey.IsValkeyNil(err) {
+			missing = append(missing, usernames[i])
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		user, err := loadUserRecord(usernames[i], userJSON)
 		if err != nil {
 			continue
 		}
-		users[username] = user
+		users[usernames[i]] = user
 	}
 
+	// Пользователи, удаленные в обход DeleteUser, убираются из индекса
+	removeFromIndex(ctx, usersIndexKey, missing...)
+
 	return users, nil
 }
 
+// getAllUsernames возвращает имена всех пользователей из индекса
+func getAllUsernames() ([]string, error) {
+	return getIndexMembers(context.Background(), usersIndexKey)
+}
+
 // SetRolePermissions устанавливает права для роли
 func SetRolePermissions(roleName string, permissions []string) error {
 	ctx := context.Background()
 	roleKey := getRolePermissionsKey(roleName)
 
+	// Роль попадает в индекс даже без прав, иначе пустую роль нельзя было бы увидеть
+	if err := addToIndex(ctx, rolesIndexKey, roleName); err != nil {
+		return fmt.Errorf("ошибка обновления индекса ролей: %v", err)
+	}
+
 	// Удаляем старые права
 	valkeyClient.Do(ctx, valkeyClient.B().Del().Key(roleKey).Build())
 
@@ -153,10 +328,11 @@ func GetRolePermissions(roleName string) ([]string, error) {
 	ctx := context.Background()
 	roleKey := getRolePermissionsKey(roleName)
 
+	// Для несуществующей роли SMEMBERS возвращает пустой набор, ошибка означает сбой Valkey
 	result := valkeyClient.Do(ctx, valkeyClient.B().Smembers().Key(roleKey).Build())
 	permissions, err := result.AsStrSlice()
 	if err != nil {
-		return []string{}, nil // Роль не существует или нет прав
+		return nil, fmt.Errorf("ошибка получения прав роли %s: %v", roleName, err)
 	}
 
 	return permissions, nil
@@ -168,44 +344,64 @@ func DeleteRole(roleName string) error {
 	roleKey := getRolePermissionsKey(roleName)
 
 	valkeyClient.Do(ctx, valkeyClient.B().Del().Key(roleKey).Build())
+	removeFromIndex(ctx, rolesIndexKey, roleName)
 
 	return nil
 }
 
+// RoleExists проверяет наличие роли в индексе
+func RoleExists(roleName string) (bool, error) {
+	ctx := context.Background()
+	exists, err := valkeyClient.Do(ctx, valkeyClient.B().Sismember().Key(rolesIndexKey).Member(roleName).Build()).AsBool()
+	if err != nil {
+		return false, fmt.Errorf("ошибка проверки роли: %v", err)
+	}
+	return exists, nil
+}
+
 // GetAllRoles получает все роли
 func GetAllRoles() (map[string][]string, error) {
 	ctx := context.Background()
 	roles := make(map[string][]string)
 
-	// Получаем все ключи ролей
-	keysResult := valkeyClient.Do(ctx, valkeyClient.B().Keys().Pattern(rolePermissionsPrefix+"*").Build())
-	keys, err := keysResult.AsStrSlice()
-	if err != nil {
-		return nil, fmt.Errorf("ошибка получения ключей: %v", err)
+	roleNames, err := getIndexMembers(ctx, rolesIndexKey)
+	if err != nil || len(roleNames) == 0 {
+		return roles, err
+	}
+
+	// Читаем права всех ролей одним конвейером
+	cmds := make(valkey.Commands, 0, len(roleNames))
+	for _, roleName := range roleNames {
+		cmds = append(cmds, valkeyClient.B().Smembers().Key(getRolePermissionsKey(roleName)).Build())
 	}
 
-	for _, key := range keys {
-		roleName := strings.TrimPrefix(key, rolePermissionsPrefix)
-		permissions, err := GetRolePermissions(roleName)
+	for i, result := range valkeyClient.DoMulti(ctx, cmds...) {
+		permissions, err := result.AsStrSlice()
 		if err != nil {
 			continue
 		}
-		roles[roleName] = permissions
+		roles[roleNames[i]] = permissions
 	}
 
 	return roles, nil
 }
 
-// GetUserPermissions получает все права пользователя (объединение прав всех его ролей)
-func GetUserPermissions(username string) ([]string, error) {
+// GetUserRoles возвращает роли пользователя.
+// Для пользователя без ролей SMEMBERS возвращает пустой набор, ошибка означает сбой Valkey.
+func GetUserRoles(username string) ([]string, error) {
 	ctx := context.Background()
-	userRolesKey := getUserRolesKey(username)
+	roles, err := valkeyClient.Do(ctx, valkeyClient.B().Smembers().Key(getUserRolesKey(username)).Build()).AsStrSlice()
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения ролей пользователя %s: %v", username, err)
+	}
+	return roles, nil
+}
 
-	// Получаем роли пользователя
-	rolesResult := valkeyClient.Do(ctx, valkeyClient.B().Smembers().Key(userRolesKey).Build())
-	roles, err := rolesResult.AsStrSlice()
+// GetUserPermissions получает все права пользователя (объединение прав всех его ролей)
+func GetUserPermissions(username string) ([]string, error) {
+	roles, err := GetUserRoles(username)
 	if err != nil {
-		return []string{}, nil // У пользователя нет ролей
+		return nil, err
 	}
 
 	// Собираем все права из всех ролей
@@ -213,7 +409,7 @@ func GetUserPermissions(username string) ([]string, error) {
 	for _, role := range roles {
 		rolePerms, err := GetRolePermissions(role)
 		if err != nil {
-			continue
+			return nil, err
 		}
 		for _, perm := range rolePerms {
 			permissionsMap[perm] = true
@@ -0,0 +1,120 @@
+// Package main - привязка сессии к отпечатку клиента.
+// При входе в сессии сохраняется подсеть IP клиента и хэш User-Agent; authMiddleware
+// сверяет их на каждом запросе и по политике роли отклоняет запрос или требует повторного входа.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/netip"
+)
+
+// Режимы привязки сессии
+const (
+	sessionBindingOff    = "off"
+	sessionBindingReauth = "reauth"
+	sessionBindingReject = "reject"
+)
+
+const (
+	defaultBindingIPv4PrefixLength = 24
+	defaultBindingIPv6PrefixLength = 64
+)
+
+// sessionBindingStrictness упорядочивает режимы от мягкого к строгому
+var sessionBindingStrictness = map[string]int{
+	sessionBindingOff:    0,
+	sessionBindingReauth: 1,
+	sessionBindingReject: 2,
+}
+
+func isValidSessionBindingMode(mode string) bool {
+	if mode == "" {
+		return true
+	}
+	_, ok := sessionBindingStrictness[mode]
+	return ok
+}
+
+// resolveSessionBinding выбирает политику привязки для набора ролей: самую мягкую из политик ролей,
+// а если ни у одной роли своей политики нет - общую. Недостающие длины префиксов заполняются по умолчанию.
+func resolveSessionBinding(roles []string, binding SessionBindingConfig) SessionBindingPolicy {
+	policy, found := binding.SessionBindingPolicy, false
+	for _, role := range roles {
+		rolePolicy, ok := binding.Roles[role]
+		if !ok {
+			continue
+		}
+		if !found || sessionBindingStrictness[rolePolicy.Mode] < sessionBindingStrictness[policy.Mode] {
+			policy = rolePolicy
+		}
+		found = true
+	}
+
+	if policy.Mode == "" {
+		policy.Mode = sessionBindingOff
+	}
+	if policy.IPv4PrefixLength <= 0 || policy.IPv4PrefixLength > 32 {
+		policy.IPv4PrefixLength = defaultBindingIPv4PrefixLength
+	}
+	if policy.IPv6PrefixLength <= 0 || policy.IPv6PrefixLength > 128 {
+		policy.IPv6PrefixLength = defaultBindingIPv6PrefixLength
+	}
+	return policy
+}
+
+// getSessionBinding возвращает политику привязки для ролей пользователя
+func getSessionBinding(roles []string) SessionBindingPolicy {
+	if config == nil {
+		return resolveSessionBinding(roles, SessionBindingConfig{})
+	}
+	return resolveSessionBinding(roles, config.Sessions.Binding)
+}
+
+// clientSubnet возвращает подсеть адреса клиента в виде CIDR, пустую строку для некорректного адреса
+func clientSubnet(clientIP string, policy SessionBindingPolicy) string {
+	addr, err := netip.ParseAddr(clientIP)
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap()
+
+	bits := policy.IPv6PrefixLength
+	if addr.Is4() {
+		bits = policy.IPv4PrefixLength
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return ""
+	}
+	return prefix.String()
+}
+
+// hashUserAgent возвращает SHA-256 от User-Agent: сам заголовок для сверки хранить не нужно
+func hashUserAgent(userAgent string) string {
+	sum := sha256.Sum256([]byte(userAgent))
+	return hex.EncodeToString(sum[:])
+}
+
+// sessionBindingMatches сверяет отпечаток запроса с сохраненным при входе.
+// Пустые поля означают, что привязка при входе не записывалась, и не проверяются,
+// но включенная привязка без записанной подсети считается несовпадением.
+func sessionBindingMatches(session *Session, clientIP, userAgent string) bool {
+	if session.BindSubnet == "" && session.BindMode != "" && session.BindMode != sessionBindingOff {
+		return false
+	}
+	if session.BindSubnet != "" {
+		prefix, err := netip.ParsePrefix(session.BindSubnet)
+		if err != nil {
+			return false
+		}
+		addr, err := netip.ParseAddr(clientIP)
+		if err != nil || !prefix.Contains(addr.Unmap()) {
+			return false
+		}
+	}
+	if session.BindUserAgentHash != "" && session.BindUserAgentHash != hashUserAgent(userAgent) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,80 @@
+package main
+
+import "testing"
+
+func TestResolveSessionBinding(t *testing.T) {
+	binding := SessionBindingConfig{
+		SessionBindingPolicy: SessionBindingPolicy{Mode: sessionBindingReauth},
+		Roles: map[string]SessionBindingPolicy{
+			"kitchen": {Mode: sessionBindingReject, IPv4PrefixLength: 32, UserAgent: true},
+			"manager": {Mode: sessionBindingOff},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		roles     []string
+		wantMode  string
+		wantIPv4  int
+		wantAgent bool
+	}{
+		{"нет ролей - общая политика", nil, sessionBindingReauth, defaultBindingIPv4PrefixLength, false},
+		{"строгая роль", []string{"kitchen"}, sessionBindingReject, 32, true},
+		{"мягкая роль", []string{"manager"}, sessionBindingOff, defaultBindingIPv4PrefixLength, false},
+		{"действует самая мягкая", []string{"kitchen", "manager"}, sessionBindingOff, defaultBindingIPv4PrefixLength, false},
+		{"роль без политики не влияет", []string{"waiter", "kitchen"}, sessionBindingReject, 32, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := resolveSessionBinding(tt.roles, binding)
+			if got.Mode != tt.wantMode || got.IPv4PrefixLength != tt.wantIPv4 || got.UserAgent != tt.wantAgent {
+				t.Errorf("resolveSessionBinding() = %+v, want mode=%s ipv4=%d userAgent=%v", got, tt.wantMode, tt.wantIPv4, tt.wantAgent)
+			}
+			if got.IPv6PrefixLength != defaultBindingIPv6PrefixLength {
+				t.Errorf("IPv6PrefixLength = %d, want %d", got.IPv6PrefixLength, defaultBindingIPv6PrefixLength)
+			}
+		})
+	}
+
+	if got := resolveSessionBinding(nil, SessionBindingConfig{}); got.Mode != sessionBindingOff {
+		t.Errorf("режим по умолчанию = %q, want %q", got.Mode, sessionBindingOff)
+	}
+}
+
+func TestSessionBindingMatches(t *testing.T) {
+	policy := SessionBindingPolicy{IPv4PrefixLength: 24, IPv6PrefixLength: 64}
+	session := &Session{
+		BindSubnet:        clientSubnet("192.168.10.25", policy),
+		BindUserAgentHash: hashUserAgent("Tablet/1.0"),
+	}
+	ipv6Session := &Session{BindSubnet: clientSubnet("2001:db8:1:2::10", policy)}
+
+	tests := []struct {
+		name      string
+		session   *Session
+		clientIP  string
+		userAgent string
+		want      bool
+	}{
+		{"тот же адрес и браузер", session, "192.168.10.25", "Tablet/1.0", true},
+		{"другой адрес в подсети", session, "192.168.10.200", "Tablet/1.0", true},
+		{"IPv4-mapped адрес в подсети", session, "::ffff:192.168.10.7", "Tablet/1.0", true},
+		{"другая подсеть", session, "192.168.11.25", "Tablet/1.0", false},
+		{"другой браузер", session, "192.168.10.25", "Desktop/2.0", false},
+		{"некорректный адрес", session, "unknown", "Tablet/1.0", false},
+		{"IPv6 в подсети /64", ipv6Session, "2001:db8:1:2::99", "", true},
+		{"IPv6 в другой подсети", ipv6Session, "2001:db8:1:3::10", "", false},
+		{"привязка не записана", &Session{}, "10.0.0.1", "Any", true},
+		{"привязка выключена", &Session{BindMode: sessionBindingOff}, "10.0.0.1", "Any", true},
+		{"подсеть не записана при включенной привязке", &Session{BindMode: sessionBindingReject}, "10.0.0.1", "Any", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sessionBindingMatches(tt.session, tt.clientIP, tt.userAgent); got != tt.want {
+				t.Errorf("sessionBindingMatches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+// Package main - ограничение числа одновременных сессий пользователя.
+// Лимит проверяется при входе по индексу user:sessions:<name>; вытесненные сессии
+// некоторое время остаются видны в списке сессий с отметкой о вытеснении.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/valkey-io/valkey-go"
+)
+
+// Политики при достижении лимита сессий
+const (
+	sessionLimitEvictOldest = "evict_oldest"
+	sessionLimitReject      = "reject"
+)
+
+const (
+	sessionEvictedReasonLimit = "session_limit"
+
+	// Сколько вытесненная сессия остается видна в GET /api/sessions
+	evictedSessionRetention = time.Hour
+)
+
+// ErrSessionLimitReached возвращается, когда лимит достигнут и политика запрещает новый вход
+var ErrSessionLimitReached = errors.New("достигнут лимит одновременных сессий")
+
+func getSessionLimitPolicy() string {
+	if config != nil && config.Sessions.Limits.Policy == sessionLimitReject {
+		return sessionLimitReject
+	}
+	return sessionLimitEvictOldest
+}
+
+// resolveSessionLimit возвращает лимит сессий для набора ролей: наибольшее из переопределений ролей,
+// а если ни у одной роли переопределения нет - общий лимит. 0 означает отсутствие лимита.
+func resolveSessionLimit(roles []string, global int, overrides map[string]int) int {
+	limit, found := 0, false
+	for _, role := range roles {
+		override, ok := overrides[role]
+		if !ok {
+			continue
+		}
+		if !found || override == 0 || (limit != 0 && override > limit) {
+			limit = override
+		}
+		found = true
+	}
+	if !found {
+		return global
+	}
+	return limit
+}
+
+// selectSessionsToEvict выбирает самые старые сессии так, чтобы после входа их стало не больше limit
+func selectSessionsToEvict(sessions []*Session, limit int) []*Session {
+	excess := len(sessions) - limit + 1
+	if limit <= 0 || excess <= 0 {
+		return nil
+	}
+
+	sorted := make([]*Session, len(sessions))
+	copy(sorted, sessions)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].CreatedAt.Before(sorted[j].CreatedAt)
+	})
+	return sorted[:excess]
+}
+
+// getUserSessions возвращает действующие сессии пользователя и вычищает истекшие из его индекса
+func getUserSessions(ctx context.Context, username string) ([]*Session, error) {
+	userSessionsKey := getUserSessionsKey(username)
+	sessionIDs, err := getIndexMembers(ctx, userSessionsKey)
+	if err != nil || len(sessionIDs) == 0 {
+		return nil, err
+	}
+
+	cmds := make(valkey.Commands, 0, len(sessionIDs))
+	for _, sessionID := range sessionIDs {
+		cmds = append(cmds, valkeyClient.B().Hgetall().Key(getSessionKey(sessionID)).Build())
+	}
+
+	var sessions []*Session
+	var expired []string
+	for i, result := range valkeyClient.DoMulti(ctx, cmds...) {
+		fields, err := result.AsStrMap()
+		if err != nil {
+			return nil, fmt.Errorf("ошибка чтения сессий пользователя: %v", err)
+		}
+		if len(fields) == 0 {
+			expired = append(expired, sessionIDs[i])
+			continue
+		}
+		sessions = append(sessions, sessionFromFields(sessionIDs[i], fields))
+	}
+
+	removeFromIndex(ctx, userSessionsKey, expired...)
+	return sessions, nil
+}
+
+// EnforceSessionLimit проверяет лимит перед созданием новой сессии пользователя.
+// При политике evict_oldest вытесняет самые старые сессии, при reject возвращает ErrSessionLimitReached.
+func EnforceSessionLimit(username string, roles []string) error {
+	if config == nil {
+		return nil
+	}
+
+	limit := resolveSessionLimit(roles, config.Sessions.Limits.MaxPerUser, config.Sessions.Limits.RoleOverrides)
+	if limit <= 0 {
+		return nil
+	}
+
+	ctx := context.Background()
+	sessions, err := getUserSessions(ctx, username)
+	if err != nil {
+		return err
+	}
+
+	toEvict := selectSessionsToEvict(sessions, limit)
+	if len(toEvict) == 0 {
+		return nil
+	}
+	if getSessionLimitPolicy() == sessionLimitReject {
+		return ErrSessionLimitReached
+	}
+
+	for _, session := range toEvict {
+		if err := EvictSession(session, sessionEvictedReasonLimit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EvictSession завершает сессию, оставляя ее запись с отметкой о вытеснении для администратора
+func EvictSession(session *Session, reason string) error {
+	ctx := context.Background()
+	sessionKey := getSessionKey(session.ID)
+
+	for _, result := range valkeyClient.DoMulti(ctx,
+		valkeyClient.B().Hset().Key(sessionKey).FieldValue().
+			FieldValue(sessionFieldEvictedAt, strconv.FormatInt(time.Now().Unix(), 10)).
+			FieldValue(sessionFieldEvictedReason, reason).
+			Build(),
+		valkeyClient.B().Expire().Key(sessionKey).Seconds(ttlSeconds(evictedSessionRetention)).Build(),
+		valkeyClient.B().Srem().Key(getUserSessionsKey(session.Username)).Member(session.ID).Build(),
+	) {
+		if err := result.Error(); err != nil {
+			return fmt.Errorf("ошибка вытеснения сессии: %v", err)
+		}
+	}
+	return nil
+}
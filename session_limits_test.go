@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResolveSessionLimit(t *testing.T) {
+	overrides := map[string]int{"waiter": 1, "manager": 3, "admin": 0}
+
+	tests := []struct {
+		name  string
+		roles []string
+		want  int
+	}{
+		{"нет ролей", nil, 5},
+		{"роль без переопределения", []string{"cook"}, 5},
+		{"одна роль с переопределением", []string{"waiter"}, 1},
+		{"действует наибольший лимит ролей", []string{"waiter", "manager"}, 3},
+		{"роль без лимита снимает ограничение", []string{"manager", "admin"}, 0},
+		{"переопределение ниже общего лимита", []string{"cook", "waiter"}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resolveSessionLimit(tt.roles, 5, overrides); got != tt.want {
+				t.Errorf("resolveSessionLimit() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectSessionsToEvict(t *testing.T) {
+	login := time.Date(2026, 1, 1, 9, 0, 0, 0, time.UTC)
+	sessions := []*Session{
+		{ID: "b", CreatedAt: login.Add(2 * time.Hour)},
+		{ID: "a", CreatedAt: login},
+		{ID: "c", CreatedAt: login.Add(3 * time.Hour)},
+	}
+
+	tests := []struct {
+		name  string
+		limit int
+		want  []string
+	}{
+		{"без лимита", 0, nil},
+		{"лимит не достигнут", 4, nil},
+		{"лимит достигнут", 3, []string{"a"}},
+		{"лимит превышен", 2, []string{"a", "b"}},
+		{"одна сессия", 1, []string{"a", "b", "c"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := selectSessionsToEvict(sessions, tt.limit)
+			if len(got) != len(tt.want) {
+				t.Fatalf("selectSessionsToEvict() вернул %d сессий, want %d", len(got), len(tt.want))
+			}
+			for i, session := range got {
+				if session.ID != tt.want[i] {
+					t.Errorf("selectSessionsToEvict()[%d] = %s, want %s", i, session.ID, tt.want[i])
+				}
+			}
+		})
+	}
+}
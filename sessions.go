@@ -0,0 +1,416 @@
+// Package main - хранилище сессий пользователей в Valkey.
+// Сессия хранится хэшем session:<id> с метаданными входа и учитывается в индексах
+// sessions:all и user:sessions:<name>.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/valkey-io/valkey-go"
+)
+
+// Ключи для хранения в Valkey
+const (
+	sessionKeyPrefix     = "session:"
+	userSessionsPrefix   = "user:sessions:"
+	sessionsMigrationKey = "migrations:sessions:hash"
+)
+
+// Поля хэша сессии
+const (
+	sessionFieldUsername  = "username"
+	sessionFieldCreatedAt = "created_at"
+	sessionFieldLastSeen  = "last_seen"
+	sessionFieldClientIP  = "client_ip"
+	sessionFieldUserAgent = "user_agent"
+	sessionFieldMethod    = "login_method"
+
+	sessionFieldBindMode      = "bind_mode"
+	sessionFieldBindSubnet    = "bind_subnet"
+	sessionFieldBindUAHash    = "bind_ua_hash"
+	sessionFieldEvictedAt     = "evicted_at"
+	sessionFieldEvictedReason = "evicted_reason"
+)
+
+const (
+	loginMethodTOTP   = "totp"
+	loginMethodLegacy = "legacy"
+
+	maxUserAgentLength = 512
+
+	defaultSessionIdleTimeoutSeconds     = 18000
+	defaultSessionAbsoluteTimeoutSeconds = 43200
+)
+
+// legacySessionKeyPattern - сессии старого формата хранились под голым 64-символьным hex ключом
+var legacySessionKeyPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Session - сессия пользователя с метаданными входа
+type Session struct {
+	ID          string
+	Username    string
+	CreatedAt   time.Time
+	LastSeen    time.Time
+	ClientIP    string
+	UserAgent   string
+	LoginMethod string
+
+	// Привязка к отпечатку клиента, зафиксированная при входе
+	BindMode          string
+	BindSubnet        string
+	BindUserAgentHash string
+
+	// EvictedAt заполнен у сессий, вытесненных из-за лимита: такие сессии недействительны
+	EvictedAt     time.Time
+	EvictedReason string
+}
+
+// Evicted сообщает, была ли сессия вытеснена
+func (s *Session) Evicted() bool {
+	return !s.EvictedAt.IsZero()
+}
+
+// getSessionKey возвращает ключ хэша сессии
+func getSessionKey(sessionID string) string {
+	return sessionKeyPrefix + sessionID
+}
+
+// getUserSessionsKey возвращает ключ индекса сессий пользователя.
+// Каждый вход продлевает индекс на предельное время жизни сессии, поэтому он не переживает свои сессии.
+func getUserSessionsKey(username string) string {
+	return userSessionsPrefix + username
+}
+
+// getSessionIdleTimeout возвращает время жизни сессии без активности
+func getSessionIdleTimeout() time.Duration {
+	if config != nil && config.Sessions.IdleTimeoutSeconds > 0 {
+		return time.Duration(config.Sessions.IdleTimeoutSeconds) * time.Second
+	}
+	if config != nil && config.Sessions.TTLSeconds > 0 {
+		return time.Duration(config.Sessions.TTLSeconds) * time.Second
+	}
+	return defaultSessionIdleTimeoutSeconds * time.Second
+}
+
+// getSessionAbsoluteTimeout возвращает предельное время жизни сессии с момента входа
+func getSessionAbsoluteTimeout() time.Duration {
+	if config != nil && config.Sessions.AbsoluteTimeoutSeconds > 0 {
+		return time.Duration(config.Sessions.AbsoluteTimeoutSeconds) * time.Second
+	}
+	return defaultSessionAbsoluteTimeoutSeconds * time.Second
+}
+
+// sessionRemainingTTL вычисляет, на сколько можно продлить сессию: на время простоя,
+// но не дальше предельного срока. Результат <= 0 означает, что сессия истекла.
+func sessionRemainingTTL(createdAt, now time.Time, idle, absolute time.Duration) time.Duration {
+	if createdAt.IsZero() {
+		return 0
+	}
+	remaining := createdAt.Add(absolute).Sub(now)
+	if remaining < idle {
+		return remaining
+	}
+	return idle
+}
+
+// ttlSeconds переводит длительность в секунды для EXPIRE с округлением вверх
+func ttlSeconds(ttl time.Duration) int64 {
+	return int64((ttl + time.Second - 1) / time.Second)
+}
+
+// CreateSession создает сессию пользователя и добавляет ее в индексы.
+// Политика привязки фиксируется в сессии: смена ролей все равно отзывает сессии пользователя.
+func CreateSession(c *gin.Context, username, loginMethod string, binding SessionBindingPolicy) (string, error) {
+	ctx := context.Background()
+	sessionID := generateSessionKey()
+	sessionKey := getSessionKey(sessionID)
+	createdAt := time.Now()
+	now := strconv.FormatInt(createdAt.Unix(), 10)
+	ttl := sessionRemainingTTL(createdAt, createdAt, getSessionIdleTimeout(), getSessionAbsoluteTimeout())
+
+	userAgent := c.Request.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+
+	bindSubnet, bindUAHash := "", ""
+	if binding.Mode != sessionBindingOff {
+		bindSubnet = clientSubnet(c.ClientIP(), binding)
+		if bindSubnet == "" {
+			return "", fmt.Errorf("не удалось определить подсеть клиента %q для привязки сессии", c.ClientIP())
+		}
+		if binding.UserAgent {
+			bindUAHash = hashUserAgent(c.Request.UserAgent())
+		}
+	}
+
+	for _, result := range valkeyClient.DoMulti(ctx,
+		valkeyClient.B().Hset().Key(sessionKey).FieldValue().
+			FieldValue(sessionFieldUsername, username).
+			FieldValue(sessionFieldCreatedAt, now).
+			FieldValue(sessionFieldLastSeen, now).
+			FieldValue(sessionFieldClientIP, c.ClientIP()).
+			FieldValue(sessionFieldUserAgent, userAgent).
+			FieldValue(sessionFieldMethod, loginMethod).
+			FieldValue(sessionFieldBindMode, binding.Mode).
+			FieldValue(sessionFieldBindSubnet, bindSubnet).
+			FieldValue(sessionFieldBindUAHash, bindUAHash).
+			Build(),
+		valkeyClient.B().Expire().Key(sessionKey).Seconds(ttlSeconds(ttl)).Build(),
+		valkeyClient.B().Sadd().Key(sessionsIndexKey).Member(sessionID).Build(),
+		valkeyClient.B().Sadd().Key(getUserSessionsKey(username)).Member(sessionID).Build(),
+		valkeyClient.B().Expire().Key(getUserSessionsKey(username)).Seconds(ttlSeconds(getSessionAbsoluteTimeout())).Build(),
+	) {
+		if err := result.Error(); err != nil {
+			return "", fmt.Errorf("ошибка создания сессии: %v", err)
+		}
+	}
+
+	return sessionID, nil
+}
+
+// GetSession возвращает сессию по идентификатору
+func GetSession(sessionID string) (*Session, error) {
+	ctx := context.Background()
+	fields, err := valkeyClient.Do(ctx, valkeyClient.B().Hgetall().Key(getSessionKey(sessionID)).Build()).AsStrMap()
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения сессии: %v", err)
+	}
+	if len(fields) == 0 || fields[sessionFieldUsername] == "" {
+		return nil, fmt.Errorf("сессия не найдена")
+	}
+	return sessionFromFields(sessionID, fields), nil
+}
+
+func sessionFromFields(sessionID string, fields map[string]string) *Session {
+	return &Session{
+		ID:          sessionID,
+		Username:    fields[sessionFieldUsername],
+		CreatedAt:   parseUnixField(fields[sessionFieldCreatedAt]),
+		LastSeen:    parseUnixField(fields[sessionFieldLastSeen]),
+		ClientIP:    fields[sessionFieldClientIP],
+		UserAgent:   fields[sessionFieldUserAgent],
+		LoginMethod: fields[sessionFieldMethod],
+
+		BindMode:          fields[sessionFieldBindMode],
+		BindSubnet:        fields[sessionFieldBindSubnet],
+		BindUserAgentHash: fields[sessionFieldBindUAHash],
+
+		EvictedAt:     parseUnixField(fields[sessionFieldEvictedAt]),
+		EvictedReason: fields[sessionFieldEvictedReason],
+	}
+}
+
+func parseUnixField(value string) time.Time {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(seconds, 0)
+}
+
+// TouchSession обновляет время последней активности и продлевает сессию в пределах
+// предельного срока. Возвращает false, если предельный срок сессии истек.
+func TouchSession(session *Session) bool {
+	now := time.Now()
+	ttl := sessionRemainingTTL(session.CreatedAt, now, getSessionIdleTimeout(), getSessionAbsoluteTimeout())
+	if ttl <= 0 {
+		return false
+	}
+
+	ctx := context.Background()
+	sessionKey := getSessionKey(session.ID)
+	valkeyClient.DoMulti(ctx,
+		valkeyClient.B().Hset().Key(sessionKey).FieldValue().FieldValue(sessionFieldLastSeen, strconv.FormatInt(now.Unix(), 10)).Build(),
+		valkeyClient.B().Expire().Key(sessionKey).Seconds(ttlSeconds(ttl)).Build(),
+	)
+	return true
+}
+
+// DeleteSession удаляет сессию и убирает ее из индексов
+func DeleteSession(sessionID string) error {
+	ctx := context.Background()
+	sessionKey := getSessionKey(sessionID)
+
+	username, err := valkeyClient.Do(ctx, valkeyClient.B().Hget().Key(sessionKey).Field(sessionFieldUsername).Build()).ToString()
+	if err != nil && !valkey.IsValkeyNil(err) {
+		return fmt.Errorf("ошибка чтения сессии: %v", err)
+	}
+
+	err = valkeyClient.Do(ctx, valkeyClient.B().Del().Key(sessionKey).Build()).Error()
+	if err != nil {
+		return fmt.Errorf("ошибка удаления сессии: %v", err)
+	}
+
+	removeFromIndex(ctx, sessionsIndexKey, sessionID)
+	if username != "" {
+		removeFromIndex(ctx, getUserSessionsKey(username), sessionID)
+	}
+	return nil
+}
+
+// RevokeUserSessions завершает все сессии пользователя, включая админ-сессии, и возвращает их количество
+func RevokeUserSessions(username string) (int, error) {
+	ctx := context.Background()
+	userSessionsKey := getUserSessionsKey(username)
+	userAdminSessionsKey := getUserAdminSessionsKey(username)
+
+	sessionIDs, err := getIndexMembers(ctx, userSessionsKey)
+	if err != nil {
+		return 0, err
+	}
+	adminSessionIDs, err := getIndexMembers(ctx, userAdminSessionsKey)
+	if err != nil {
+		return 0, err
+	}
+
+	sessionCount := len(sessionIDs) + len(adminSessionIDs)
+	cmds := make(valkey.Commands, 0, sessionCount+2)
+	for _, sessionID := range sessionIDs {
+		cmds = append(cmds, valkeyClient.B().Del().Key(getSessionKey(sessionID)).Build())
+	}
+	for _, sessionID := range adminSessionIDs {
+		cmds = append(cmds, valkeyClient.B().Del().Key(getAdminSessionKey(sessionID)).Build())
+	}
+	cmds = append(cmds,
+		valkeyClient.B().Del().Key(userSessionsKey).Build(),
+		valkeyClient.B().Del().Key(userAdminSessionsKey).Build(),
+	)
+
+	revoked := 0
+	for i, result := range valkeyClient.DoMulti(ctx, cmds...) {
+		deleted, err := result.AsInt64()
+		if err != nil {
+			return revoked, fmt.Errorf("ошибка завершения сессий: %v", err)
+		}
+		if i < sessionCount && deleted > 0 {
+			revoked++
+		}
+	}
+
+	removeFromIndex(ctx, sessionsIndexKey, sessionIDs...)
+	return revoked, nil
+}
+
+// GetAllSessions возвращает все действующие сессии и вычищает из индексов истекшие
+func GetAllSessions() ([]SessionResponse, error) {
+	ctx := context.Background()
+	sessions := []SessionResponse{}
+
+	sessionIDs, err := getIndexMembers(ctx, sessionsIndexKey)
+	if err != nil || len(sessionIDs) == 0 {
+		return sessions, err
+	}
+
+	// HGETALL и TTL всех сессий одним конвейером: по паре команд на сессию
+	cmds := make(valkey.Commands, 0, 2*len(sessionIDs))
+	for _, sessionID := range sessionIDs {
+		cmds = append(cmds,
+			valkeyClient.B().Hgetall().Key(getSessionKey(sessionID)).Build(),
+			valkeyClient.B().Ttl().Key(getSessionKey(sessionID)).Build(),
+		)
+	}
+	results := valkeyClient.DoMulti(ctx, cmds...)
+
+	var expired []string
+	for i, sessionID := range sessionIDs {
+		fields, err := results[2*i].AsStrMap()
+		if err != nil {
+			continue
+		}
+		if len(fields) == 0 {
+			expired = append(expired, sessionID)
+			continue
+		}
+
+		ttl, err := results[2*i+1].AsInt64()
+		if err != nil {
+			ttl = -1
+		}
+
+		sessions = append(sessions, newSessionResponse(sessionFromFields(sessionID, fields), ttl))
+	}
+
+	// Сессии, истекшие по TTL, остаются в индексах до первого чтения. Владелец истекшей сессии
+	// неизвестен: индекс пользователя чистит getUserSessions, а сам индекс живет не дольше его сессий.
+	removeFromIndex(ctx, sessionsIndexKey, expired...)
+
+	return sessions, nil
+}
+
+// MigrateLegacySessions однократно переносит сессии старого формата (ключ - id, значение - имя)
+// в хэши session:<id>, сохраняя оставшийся TTL
+func MigrateLegacySessions() error {
+	ctx := context.Background()
+
+	done, err := valkeyClient.Do(ctx, valkeyClient.B().Exists().Key(sessionsMigrationKey).Build()).AsInt64()
+	if err != nil {
+		return fmt.Errorf("ошибка проверки миграции сессий: %v", err)
+	}
+	if done == 1 {
+		return nil
+	}
+
+	keys, err := scanKeys(ctx, "*")
+	if err != nil {
+		return err
+	}
+
+	migrated := 0
+	for _, sessionID := range keys {
+		if !legacySessionKeyPattern.MatchString(sessionID) {
+			continue
+		}
+
+		results := valkeyClient.DoMulti(ctx,
+			valkeyClient.B().Get().Key(sessionID).Build(),
+			valkeyClient.B().Ttl().Key(sessionID).Build(),
+		)
+		username, err := results[0].ToString()
+		if err != nil {
+			continue
+		}
+		ttl, err := results[1].AsInt64()
+		if err != nil || ttl <= 0 {
+			ttl = ttlSeconds(getSessionIdleTimeout())
+		}
+
+		// Время входа старых сессий неизвестно, берем время миграции
+		now := strconv.FormatInt(time.Now().Unix(), 10)
+		sessionKey := getSessionKey(sessionID)
+		for _, result := range valkeyClient.DoMulti(ctx,
+			valkeyClient.B().Hset().Key(sessionKey).FieldValue().
+				FieldValue(sessionFieldUsername, username).
+				FieldValue(sessionFieldCreatedAt, now).
+				FieldValue(sessionFieldLastSeen, now).
+				FieldValue(sessionFieldMethod, loginMethodLegacy).
+				Build(),
+			valkeyClient.B().Expire().Key(sessionKey).Seconds(ttl).Build(),
+			valkeyClient.B().Sadd().Key(sessionsIndexKey).Member(sessionID).Build(),
+			valkeyClient.B().Sadd().Key(getUserSessionsKey(username)).Member(sessionID).Build(),
+			valkeyClient.B().Expire().Key(getUserSessionsKey(username)).Seconds(ttlSeconds(getSessionAbsoluteTimeout())).Build(),
+			valkeyClient.B().Del().Key(sessionID).Build(),
+		) {
+			if err := result.Error(); err != nil {
+				return fmt.Errorf("ошибка миграции сессии: %v", err)
+			}
+		}
+		migrated++
+	}
+
+	err = valkeyClient.Do(ctx, valkeyClient.B().Set().Key(sessionsMigrationKey).Value(strconv.FormatInt(time.Now().Unix(), 10)).Build()).Error()
+	if err != nil {
+		return fmt.Errorf("ошибка сохранения отметки миграции сессий: %v", err)
+	}
+
+	if migrated > 0 {
+		log.Printf("Перенесено сессий старого формата: %d", migrated)
+	}
+	return nil
+}
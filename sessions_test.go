@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSessionRemainingTTL(t *testing.T) {
+	idle := 30 * time.Minute
+	absolute := 8 * time.Hour
+	login := time.Date(2026, 1, 1, 9, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		createdAt time.Time
+		now       time.Time
+		want      time.Duration
+	}{
+		{"сразу после входа", login, login, idle},
+		{"активная сессия далеко от предела", login, login.Add(2 * time.Hour), idle},
+		{"до предела меньше времени простоя", login, login.Add(7*time.Hour + 50*time.Minute), 10 * time.Minute},
+		{"предел достигнут", login, login.Add(absolute), 0},
+		{"предел превышен", login, login.Add(absolute + time.Minute), -time.Minute},
+		{"нет времени входа", time.Time{}, login, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sessionRemainingTTL(tt.createdAt, tt.now, idle, absolute); got != tt.want {
+				t.Errorf("sessionRemainingTTL() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// addTestSession записывает сессию в Valkey вместе с индексами, как CreateSession
+func addTestSession(t *testing.T, sessionID, username string) {
+	t.Helper()
+	ctx := context.Background()
+	for _, result := range valkeyClient.DoMulti(ctx,
+		valkeyClient.B().Hset().Key(getSessionKey(sessionID)).FieldValue().
+			FieldValue(sessionFieldUsername, username).
+			FieldValue(sessionFieldCreatedAt, strconv.FormatInt(time.Now().Unix(), 10)).
+			Build(),
+		valkeyClient.B().Sadd().Key(sessionsIndexKey).Member(sessionID).Build(),
+		valkeyClient.B().Sadd().Key(getUserSessionsKey(username)).Member(sessionID).Build(),
+		valkeyClient.B().Sadd().Key(usersIndexKey).Member(username).Build(),
+	) {
+		if err := result.Error(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExpiredSessionsLeaveIndexes(t *testing.T) {
+	server := setupTestValkey(t)
+	addTestSession(t, "active", "waiter")
+	addTestSession(t, "expired-waiter", "waiter")
+	addTestSession(t, "expired-kitchen", "kitchen")
+
+	// Истечение TTL: хэши удалены, идентификаторы остались в индексах
+	server.Del(getSessionKey("expired-waiter"))
+	server.Del(getSessionKey("expired-kitchen"))
+
+	sessions, err := GetAllSessions()
+	if err != nil || len(sessions) != 1 {
+		t.Fatalf("GetAllSessions() = %d сессий, %v; want 1", len(sessions), err)
+	}
+	waiterSessions, err := getUserSessions(context.Background(), "waiter")
+	if err != nil || len(waiterSessions) != 1 {
+		t.Fatalf("getUserSessions() = %d сессий, %v; want 1", len(waiterSessions), err)
+	}
+
+	tests := []struct {
+		name     string
+		indexKey string
+		want     []string
+	}{
+		{"общий индекс чистит список сессий", sessionsIndexKey, []string{"active"}},
+		{"индекс пользователя чистит getUserSessions", getUserSessionsKey("waiter"), []string{"active"}},
+		{"индекс другого пользователя не трогается", getUserSessionsKey("kitchen"), []string{"expired-kitchen"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			members, err := getIndexMembers(context.Background(), tt.indexKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(members, tt.want) {
+				t.Errorf("%s = %v, want %v", tt.indexKey, members, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateSessionExpiresUserIndex(t *testing.T) {
+	server := setupTestValkey(t)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "https://auth.secure-proxy.lan/login", nil)
+
+	if _, err := CreateSession(c, "waiter", loginMethodTOTP, SessionBindingPolicy{Mode: sessionBindingOff}); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := server.TTL(getUserSessionsKey("waiter")); ttl != getSessionAbsoluteTimeout() {
+		t.Errorf("TTL индекса сессий пользователя = %v, want %v", ttl, getSessionAbsoluteTimeout())
+	}
+
+	// Индекс, переживший свои сессии, удаляется Valkey
+	server.FastForward(getSessionAbsoluteTimeout())
+	if server.Exists(getUserSessionsKey("waiter")) {
+		t.Error("индекс сессий пользователя не истек вместе с сессиями")
+	}
+}
+
+func TestRevokeUserSessionsIncludesAdminSessions(t *testing.T) {
+	setupTestValkey(t)
+	if err := SetRolePermissions("admin", []string{getAdminPermission()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveUser("manager", "", []string{"admin"}); err != nil {
+		t.Fatal(err)
+	}
+	addTestSession(t, "manager-tablet", "manager")
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "https://auth.secure-proxy.lan/login", nil)
+	if err := issueAdminSession(c, "manager"); err != nil {
+		t.Fatal(err)
+	}
+	adminSessionIDs, err := getIndexMembers(context.Background(), getUserAdminSessionsKey("manager"))
+	if err != nil || len(adminSessionIDs) != 1 {
+		t.Fatalf("индекс админ-сессий = %v, %v; want одну сессию", adminSessionIDs, err)
+	}
+
+	revoked, err := RevokeUserSessions("manager")
+	if err != nil || revoked != 2 {
+		t.Fatalf("RevokeUserSessions() = %d, %v; want 2", revoked, err)
+	}
+
+	exists, err := valkeyClient.Do(context.Background(), valkeyClient.B().Exists().
+		Key(getSessionKey("manager-tablet"), getAdminSessionKey(adminSessionIDs[0]), getUserAdminSessionsKey("manager")).Build()).AsInt64()
+	if err != nil || exists != 0 {
+		t.Errorf("после завершения осталось ключей: %d, %v", exists, err)
+	}
+}
+
+func TestCreateSessionRejectsUnknownClientForBinding(t *testing.T) {
+	setupTestValkey(t)
+	policy := SessionBindingPolicy{Mode: sessionBindingReject, IPv4PrefixLength: 24, IPv6PrefixLength: 64}
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "https://auth.secure-proxy.lan/login", nil)
+	c.Request.RemoteAddr = "unknown"
+	if sessionID, err := CreateSession(c, "cashier", loginMethodTOTP, policy); err == nil {
+		t.Fatalf("CreateSession() = %q, want ошибку для нераспознанного адреса", sessionID)
+	}
+
+	c.Request.RemoteAddr = "192.168.10.25:51000"
+	sessionID, err := CreateSession(c, "cashier", loginMethodTOTP, policy)
+	if err != nil {
+		t.Fatalf("CreateSession() error = %v", err)
+	}
+	session, err := GetSession(sessionID)
+	if err != nil || session.BindSubnet != "192.168.10.0/24" {
+		t.Errorf("подсеть сессии = %+v, %v; want 192.168.10.0/24", session, err)
+	}
+}
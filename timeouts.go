@@ -0,0 +1,156 @@
+// Package main - ограничения запроса к upstream: общий таймаут до получения ответа и размер тела.
+// Таймауты соединения и ожидания заголовков ответа задаются в настройках транспорта upstream.
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultUpstreamRequestTimeoutSeconds = 60
+	defaultMaxRequestBodyBytes           = 10 << 20
+)
+
+// getRequestTimeout возвращает общий таймаут запроса к upstream до получения заголовков ответа вместе с повторами
+func (u *upstreamProxy) getRequestTimeout() time.Duration {
+	return secondsOrDefault(u.config.RequestTimeoutSeconds, defaultUpstreamRequestTimeoutSeconds)
+}
+
+// getMaxRequestBodyBytes возвращает предельный размер тела запроса, 0 - без ограничения
+func (u *upstreamProxy) getMaxRequestBodyBytes() int64 {
+	switch {
+	case u.config.MaxRequestBodyBytes < 0:
+		return 0
+	case u.config.MaxRequestBodyBytes == 0:
+		return defaultMaxRequestBodyBytes
+	}
+	return u.config.MaxRequestBodyBytes
+}
+
+// requestBody отслеживает чтение тела запроса клиента: дочитано ли оно и чем закончилось.
+// Тело читает транспорт в своей горутине, поэтому состояние защищено мьютексом.
+type requestBody struct {
+	io.ReadCloser
+
+	mu       sync.Mutex
+	complete bool
+	err      error
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.mu.Lock()
+		if err == io.EOF {
+			b.complete = true
+		} else if b.err == nil {
+			b.err = err
+		}
+		b.mu.Unlock()
+	}
+	return n, err
+}
+
+// state возвращает, дочитано ли тело, и ошибку чтения
+func (b *requestBody) state() (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.complete, b.err
+}
+
+// requestTimeout - общий таймаут запроса к upstream. Он ограничивает передачу тела запроса
+// и ожидание заголовков ответа вместе с повторами, а после получения заголовков снимается:
+// скачивание файлов, потоковые ответы и WebSocket не обрываются.
+type requestTimeout struct {
+	timer  *time.Timer
+	writer http.ResponseWriter
+	cancel context.CancelCauseFunc
+}
+
+// headersReceived снимает таймаут и дедлайн чтения тела запроса: ответ upstream получен
+func (t *requestTimeout) headersReceived() {
+	if t.timer.Stop() {
+		http.NewResponseController(t.writer).SetReadDeadline(time.Time{})
+	}
+}
+
+// release останавливает таймер и отменяет контекст запроса после его обработки
+func (t *requestTimeout) release() {
+	t.timer.Stop()
+	t.cancel(nil)
+}
+
+// isRequestTimedOut сообщает, отменен ли контекст запроса по общему таймауту
+func isRequestTimedOut(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), context.DeadlineExceeded)
+}
+
+// limitRequest ограничивает тело запроса и время его обработки.
+// Возвращает отслеживаемое тело (nil, если тела нет) и общий таймаут запроса.
+func (u *upstreamProxy) limitRequest(c *gin.Context) (*requestBody, *requestTimeout) {
+	timeout := u.getRequestTimeout()
+	ctx, cancel := context.WithCancelCause(c.Request.Context())
+	c.Request = c.Request.WithContext(ctx)
+	limit := &requestTimeout{
+		timer:  time.AfterFunc(timeout, func() { cancel(context.DeadlineExceeded) }),
+		writer: c.Writer,
+		cancel: cancel,
+	}
+
+	// Медленная передача тела тоже ограничена таймаутом запроса. У Upgrade запроса тела нет,
+	// а дедлайн остался бы на перехваченном соединении WebSocket.
+	if c.Request.Header.Get("Upgrade") == "" {
+		http.NewResponseController(c.Writer).SetReadDeadline(time.Now().Add(timeout))
+	}
+
+	if c.Request.Body == nil || c.Request.Body == http.NoBody || c.Request.ContentLength == 0 {
+		return nil, limit
+	}
+
+	body := c.Request.Body
+	if maxBytes := u.getMaxRequestBodyBytes(); maxBytes > 0 {
+		body = http.MaxBytesReader(c.Writer, body, maxBytes)
+	}
+	tracked := &requestBody{ReadCloser: body}
+	c.Request.Body = tracked
+	return tracked, limit
+}
+
+// isTimeoutError сообщает, вызвана ли ошибка истечением таймаута
+func isTimeoutError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// upstreamErrorStatus выбирает статус ответа клиенту по ошибке запроса к upstream:
+// 413 - тело больше допустимого, 408 - клиент не успел передать тело,
+// 504 - upstream не ответил вовремя, 502 - прочие ошибки upstream
+func upstreamErrorStatus(err error, body *requestBody) int {
+	complete, bodyErr := true, error(nil)
+	if body != nil {
+		complete, bodyErr = body.state()
+	}
+
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) || errors.As(bodyErr, &maxBytesErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+	if isTimeoutError(err) || isTimeoutError(bodyErr) {
+		if !complete {
+			return http.StatusRequestTimeout
+		}
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
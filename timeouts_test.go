@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestUpstreamErrorStatus(t *testing.T) {
+	tooLarge := &http.MaxBytesError{Limit: 10}
+	readTimeout := &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}
+
+	tests := []struct {
+		name     string
+		err      error
+		complete bool
+		bodyErr  error
+		want     int
+	}{
+		{"ошибка соединения", errors.New("connection refused"), true, nil, http.StatusBadGateway},
+		{"общий таймаут", context.DeadlineExceeded, true, nil, http.StatusGatewayTimeout},
+		{"превышен размер тела", tooLarge, false, tooLarge, http.StatusRequestEntityTooLarge},
+		{"таймаут при передаче тела", context.DeadlineExceeded, false, nil, http.StatusRequestTimeout},
+		{"таймаут чтения тела", errors.New("write body"), false, readTimeout, http.StatusRequestTimeout},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := &requestBody{ReadCloser: io.NopCloser(strings.NewReader("")), complete: tt.complete, err: tt.bodyErr}
+			if got := upstreamErrorStatus(tt.err, body); got != tt.want {
+				t.Errorf("upstreamErrorStatus() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	if got := upstreamErrorStatus(context.DeadlineExceeded, nil); got != http.StatusGatewayTimeout {
+		t.Errorf("запрос без тела: %d, want 504", got)
+	}
+}
+
+func TestServeUpstreamLimits(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(1500 * time.Millisecond)
+		}
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer backend.Close()
+
+	upstreams := []UpstreamConfig{{
+		Host:                  "rest.secure-proxy.lan",
+		Destination:           backend.URL,
+		RequestTimeoutSeconds: 1,
+		MaxRequestBodyBytes:   16,
+	}}
+	loadTestUpstreams(t, upstreams)
+
+	engine := gin.New()
+	engine.LoadHTMLGlob("templates/*")
+	engine.NoRoute(handlePublicProxy)
+
+	tests := []struct {
+		name          string
+		path          string
+		body          io.Reader
+		contentLength int64
+		want          int
+	}{
+		{"тело в пределах лимита", "/orders", strings.NewReader(`{"table":7}`), 11, http.StatusOK},
+		{"заявленная длина больше лимита", "/orders", strings.NewReader(strings.Repeat("x", 32)), 32, http.StatusRequestEntityTooLarge},
+		{"потоковое тело больше лимита", "/orders", strings.NewReader(strings.Repeat("x", 32)), -1, http.StatusRequestEntityTooLarge},
+		{"upstream не ответил вовремя", "/slow", nil, 0, http.StatusGatewayTimeout},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "http://rest.secure-proxy.lan"+tt.path, tt.body)
+			req.Host = "rest.secure-proxy.lan"
+			req.ContentLength = tt.contentLength
+			req.Header.Set("Accept", "application/json")
+			recorder := closeNotifyRecorder{httptest.NewRecorder()}
+			engine.ServeHTTP(recorder, req)
+
+			if recorder.Code != tt.want {
+				t.Errorf("статус %d, want %d", recorder.Code, tt.want)
+			}
+			if tt.want != http.StatusOK && !strings.Contains(recorder.Body.String(), `"detail"`) {
+				t.Errorf("ответ %q, want JSON ошибку", recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestServeUpstreamStreamsLongerThanTimeout(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Заголовки приходят сразу, а тело передается дольше общего таймаута
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 5; i++ {
+			io.WriteString(w, "data: заказ готов\n\n")
+			w.(http.Flusher).Flush()
+			time.Sleep(300 * time.Millisecond)
+		}
+	}))
+	defer backend.Close()
+
+	upstreams := []UpstreamConfig{{
+		Host:                  "rest.secure-proxy.lan",
+		Destination:           backend.URL,
+		RequestTimeoutSeconds: 1,
+	}}
+	loadTestUpstreams(t, upstreams)
+
+	engine := gin.New()
+	engine.LoadHTMLGlob("templates/*")
+	engine.NoRoute(handlePublicProxy)
+	proxy := httptest.NewServer(engine)
+	defer proxy.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/kitchen/events", nil)
+	req.Host = "rest.secure-proxy.lan"
+	resp, err := proxy.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("поток оборван: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || strings.Count(string(body), "data:") != 5 {
+		t.Errorf("статус %d, тело %q: want 200 и пять событий", resp.StatusCode, body)
+	}
+}
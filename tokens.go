@@ -0,0 +1,304 @@
+// Package main - персональные API токены для скриптов и устройств без ввода TOTP.
+// Токен выпускает администратор; в Valkey хранится только SHA-256 секрета, срок действия
+// и время последнего использования. Токен может быть ограничен частью прав пользователя.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valkey-io/valkey-go"
+)
+
+// Ключи для хранения в Valkey
+const (
+	apiTokenKeyPrefix   = "apitoken:"
+	userTokensKeyPrefix = "user:tokens:"
+)
+
+const (
+	// apiTokenPrefix отличает API токен от других секретов, например при поиске утечек в логах
+	apiTokenPrefix = "spt"
+
+	defaultAPITokenLifetimeDays    = 90
+	defaultAPITokenMaxLifetimeDays = 365
+
+	// Время последнего использования обновляется не чаще раза в минуту
+	apiTokenLastUsedResolution = time.Minute
+)
+
+// Поля хэша токена
+const (
+	apiTokenFieldUsername   = "username"
+	apiTokenFieldName       = "name"
+	apiTokenFieldSecretHash = "secret_hash"
+	apiTokenFieldScopes     = "scopes"
+	apiTokenFieldCreatedAt  = "created_at"
+	apiTokenFieldExpiresAt  = "expires_at"
+	apiTokenFieldLastUsed   = "last_used"
+	apiTokenFieldCreatedBy  = "created_by"
+)
+
+// APIToken - сохраненный API токен без секрета
+type APIToken struct {
+	ID        string
+	Username  string
+	Name      string
+	Scopes    []string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	LastUsed  time.Time
+	CreatedBy string
+
+	secretHash string
+}
+
+func getAPITokenKey(tokenID string) string {
+	return apiTokenKeyPrefix + tokenID
+}
+
+func getUserTokensKey(username string) string {
+	return userTokensKeyPrefix + username
+}
+
+// getAPITokenLifetime возвращает срок действия токена: запрошенный, по умолчанию или предельный
+func getAPITokenLifetime(requestedDays int) time.Duration {
+	maxDays := defaultAPITokenMaxLifetimeDays
+	if config != nil && config.Security.APITokens.MaxLifetimeDays > 0 {
+		maxDays = config.Security.APITokens.MaxLifetimeDays
+	}
+
+	days := requestedDays
+	if days <= 0 {
+		days = defaultAPITokenLifetimeDays
+	}
+	if days > maxDays {
+		days = maxDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// formatAPIToken собирает токен для клиента: spt_<id>_<секрет>
+func formatAPIToken(tokenID, secret string) string {
+	return apiTokenPrefix + "_" + tokenID + "_" + secret
+}
+
+// parseAPIToken разбирает токен на идентификатор и секрет
+func parseAPIToken(token string) (string, string, bool) {
+	parts := strings.Split(token, "_")
+	if len(parts) != 3 || parts[0] != apiTokenPrefix || parts[1] == "" || parts[2] == "" {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+func hashAPITokenSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// restrictPermissions оставляет права пользователя, входящие в области токена
+func restrictPermissions(permissions, scopes []string) []string {
+	allowed := make(map[string]bool, len(scopes))
+	for _, scope := range scopes {
+		allowed[scope] = true
+	}
+
+	restricted := make([]string, 0, len(scopes))
+	for _, permission := range permissions {
+		if allowed[permission] {
+			restricted = append(restricted, permission)
+		}
+	}
+	return restricted
+}
+
+func randomHex(size int) string {
+	bytes := make([]byte, size)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
+// CreateAPIToken выпускает токен пользователя и возвращает его вместе с секретом.
+// Секрет возвращается только здесь: в Valkey сохраняется лишь его хэш.
+func CreateAPIToken(username, name string, scopes []string, lifetime time.Duration, createdBy string) (*APIToken, string, error) {
+	ctx := context.Background()
+	tokenID := randomHex(8)
+	secret := randomHex(32)
+	tokenKey := getAPITokenKey(tokenID)
+
+	token := &APIToken{
+		ID:        tokenID,
+		Username:  username,
+		Name:      name,
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+		CreatedBy: createdBy,
+	}
+	token.ExpiresAt = token.CreatedAt.Add(lifetime)
+
+	for _, result := range valkeyClient.DoMulti(ctx,
+		valkeyClient.B().Hset().Key(tokenKey).FieldValue().
+			FieldValue(apiTokenFieldUsername, username).
+			FieldValue(apiTokenFieldName, name).
+			FieldValue(apiTokenFieldSecretHash, hashAPITokenSecret(secret)).
+			FieldValue(apiTokenFieldScopes, strings.Join(scopes, ",")).
+			FieldValue(apiTokenFieldCreatedAt, strconv.FormatInt(token.CreatedAt.Unix(), 10)).
+			FieldValue(apiTokenFieldExpiresAt, strconv.FormatInt(token.ExpiresAt.Unix(), 10)).
+			FieldValue(apiTokenFieldCreatedBy, createdBy).
+			Build(),
+		valkeyClient.B().Expire().Key(tokenKey).Seconds(ttlSeconds(lifetime)).Build(),
+		valkeyClient.B().Sadd().Key(getUserTokensKey(username)).Member(tokenID).Build(),
+	) {
+		if err := result.Error(); err != nil {
+			return nil, "", fmt.Errorf("ошибка сохранения токена: %v", err)
+		}
+	}
+
+	return token, formatAPIToken(tokenID, secret), nil
+}
+
+func apiTokenFromFields(tokenID string, fields map[string]string) *APIToken {
+	var scopes []string
+	if fields[apiTokenFieldScopes] != "" {
+		scopes = strings.Split(fields[apiTokenFieldScopes], ",")
+	}
+	return &APIToken{
+		ID:         tokenID,
+		Username:   fields[apiTokenFieldUsername],
+		Name:       fields[apiTokenFieldName],
+		Scopes:     scopes,
+		CreatedAt:  parseUnixField(fields[apiTokenFieldCreatedAt]),
+		ExpiresAt:  parseUnixField(fields[apiTokenFieldExpiresAt]),
+		LastUsed:   parseUnixField(fields[apiTokenFieldLastUsed]),
+		CreatedBy:  fields[apiTokenFieldCreatedBy],
+		secretHash: fields[apiTokenFieldSecretHash],
+	}
+}
+
+// AuthenticateAPIToken проверяет токен из заголовка Authorization и отмечает его использование
+func AuthenticateAPIToken(rawToken string) (*APIToken, error) {
+	tokenID, secret, ok := parseAPIToken(rawToken)
+	if !ok {
+		return nil, fmt.Errorf("неверный формат токена")
+	}
+
+	ctx := context.Background()
+	tokenKey := getAPITokenKey(tokenID)
+	fields, err := valkeyClient.Do(ctx, valkeyClient.B().Hgetall().Key(tokenKey).Build()).AsStrMap()
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения токена: %v", err)
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("токен не найден")
+	}
+
+	token := apiTokenFromFields(tokenID, fields)
+	if subtle.ConstantTimeCompare([]byte(token.secretHash), []byte(hashAPITokenSecret(secret))) != 1 {
+		return nil, fmt.Errorf("неверный токен")
+	}
+
+	now := time.Now()
+	if !token.ExpiresAt.IsZero() && !now.Before(token.ExpiresAt) {
+		return nil, fmt.Errorf("срок действия токена истек")
+	}
+
+	if now.Sub(token.LastUsed) >= apiTokenLastUsedResolution {
+		valkeyClient.Do(ctx, valkeyClient.B().Hset().Key(tokenKey).FieldValue().
+			FieldValue(apiTokenFieldLastUsed, strconv.FormatInt(now.Unix(), 10)).
+			Build())
+		token.LastUsed = now
+	}
+
+	return token, nil
+}
+
+// GetUserAPITokens возвращает действующие токены пользователя и вычищает истекшие из индекса
+func GetUserAPITokens(username string) ([]*APIToken, error) {
+	ctx := context.Background()
+	userTokensKey := getUserTokensKey(username)
+
+	tokenIDs, err := getIndexMembers(ctx, userTokensKey)
+	if err != nil || len(tokenIDs) == 0 {
+		return nil, err
+	}
+
+	cmds := make(valkey.Commands, 0, len(tokenIDs))
+	for _, tokenID := range tokenIDs {
+		cmds = append(cmds, valkeyClient.B().Hgetall().Key(getAPITokenKey(tokenID)).Build())
+	}
+
+	var tokens []*APIToken
+	var expired []string
+	for i, result := range valkeyClient.DoMulti(ctx, cmds...) {
+		fields, err := result.AsStrMap()
+		if err != nil {
+			return nil, fmt.Errorf("ошибка чтения токенов: %v", err)
+		}
+		if len(fields) == 0 {
+			expired = append(expired, tokenIDs[i])
+			continue
+		}
+		tokens = append(tokens, apiTokenFromFields(tokenIDs[i], fields))
+	}
+
+	removeFromIndex(ctx, userTokensKey, expired...)
+	return tokens, nil
+}
+
+// RevokeAPIToken отзывает токен пользователя. Возвращает false, если такого токена нет.
+func RevokeAPIToken(username, tokenID string) (bool, error) {
+	ctx := context.Background()
+	tokenKey := getAPITokenKey(tokenID)
+
+	owner, err := valkeyClient.Do(ctx, valkeyClient.B().Hget().Key(tokenKey).Field(apiTokenFieldUsername).Build()).ToString()
+	if valkey.IsValkeyNil(err) || (err == nil && owner != username) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("ошибка чтения токена: %v", err)
+	}
+
+	err = valkeyClient.Do(ctx, valkeyClient.B().Del().Key(tokenKey).Build()).Error()
+	if err != nil {
+		return false, fmt.Errorf("ошибка отзыва токена: %v", err)
+	}
+	removeFromIndex(ctx, getUserTokensKey(username), tokenID)
+	return true, nil
+}
+
+// RevokeUserAPITokens отзывает все токены пользователя и возвращает их количество
+func RevokeUserAPITokens(username string) (int, error) {
+	ctx := context.Background()
+	userTokensKey := getUserTokensKey(username)
+
+	tokenIDs, err := getIndexMembers(ctx, userTokensKey)
+	if err != nil {
+		return 0, err
+	}
+
+	cmds := make(valkey.Commands, 0, len(tokenIDs)+1)
+	for _, tokenID := range tokenIDs {
+		cmds = append(cmds, valkeyClient.B().Del().Key(getAPITokenKey(tokenID)).Build())
+	}
+	cmds = append(cmds, valkeyClient.B().Del().Key(userTokensKey).Build())
+
+	revoked := 0
+	for i, result := range valkeyClient.DoMulti(ctx, cmds...) {
+		deleted, err := result.AsInt64()
+		if err != nil {
+			return revoked, fmt.Errorf("ошибка отзыва токенов: %v", err)
+		}
+		if i < len(tokenIDs) && deleted > 0 {
+			revoked++
+		}
+	}
+	return revoked, nil
+}
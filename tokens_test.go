@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseAPIToken(t *testing.T) {
+	tests := []struct {
+		name       string
+		token      string
+		wantID     string
+		wantSecret string
+		wantOK     bool
+	}{
+		{"корректный токен", formatAPIToken("0a1b", "c2d3"), "0a1b", "c2d3", true},
+		{"чужой префикс", "ghp_0a1b_c2d3", "", "", false},
+		{"нет секрета", "spt_0a1b_", "", "", false},
+		{"лишняя часть", "spt_0a1b_c2d3_e4", "", "", false},
+		{"пустая строка", "", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, secret, ok := parseAPIToken(tt.token)
+			if id != tt.wantID || secret != tt.wantSecret || ok != tt.wantOK {
+				t.Errorf("parseAPIToken(%q) = (%q, %q, %v), want (%q, %q, %v)", tt.token, id, secret, ok, tt.wantID, tt.wantSecret, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+		wantOK bool
+	}{
+		{"Bearer spt_a_b", "spt_a_b", true},
+		{"bearer spt_a_b", "spt_a_b", true},
+		{"Basic dXNlcjpwYXNz", "", false},
+		{"Bearer ", "", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			got, ok := bearerToken(tt.header)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("bearerToken(%q) = (%q, %v), want (%q, %v)", tt.header, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestRestrictPermissions(t *testing.T) {
+	permissions := []string{"kitchen.secure-proxy.lan", "rest.secure-proxy.lan/waiter"}
+
+	tests := []struct {
+		name   string
+		scopes []string
+		want   []string
+	}{
+		{"одна область", []string{"kitchen.secure-proxy.lan"}, []string{"kitchen.secure-proxy.lan"}},
+		{"область без права у пользователя", []string{"warehouse.secure-proxy.lan"}, []string{}},
+		{"все права", permissions, permissions},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := restrictPermissions(permissions, tt.scopes); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("restrictPermissions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetAPITokenLifetime(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = &Config{Security: SecurityConfig{APITokens: APITokensConfig{MaxLifetimeDays: 30}}}
+
+	day := 24 * time.Hour
+	tests := []struct {
+		name      string
+		requested int
+		want      time.Duration
+	}{
+		{"запрошенный срок", 7, 7 * day},
+		{"по умолчанию ограничен предельным", 0, 30 * day},
+		{"больше предельного", 400, 30 * day},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getAPITokenLifetime(tt.requested); got != tt.want {
+				t.Errorf("getAPITokenLifetime(%d) = %v, want %v", tt.requested, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthMiddlewareBearerTokens(t *testing.T) {
+	setupTestValkey(t)
+	saved := config
+	config = &Config{Sessions: SessionsConfig{CookieName: "secure_proxy_session"}}
+	t.Cleanup(func() { config = saved })
+
+	if err := SaveUser("cashier", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	addTestSession(t, "cashier-tablet", "cashier")
+
+	tests := []struct {
+		name          string
+		authorization string
+		cookie        bool
+		wantStatus    int
+		wantHeader    string
+	}{
+		{"сессия и токен upstream-приложения", "Bearer eyJhbGciOiJIUzI1NiJ9.app", true, http.StatusOK, "Bearer eyJhbGciOiJIUzI1NiJ9.app"},
+		{"токен upstream-приложения без сессии", "Bearer eyJhbGciOiJIUzI1NiJ9.app", false, http.StatusFound, ""},
+		{"недействительный токен прокси", "Bearer spt_missing_secret", true, http.StatusUnauthorized, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotHeader string
+			engine := gin.New()
+			engine.Use(authMiddleware())
+			engine.GET("/orders", func(c *gin.Context) {
+				gotHeader = c.GetHeader("Authorization")
+				c.String(http.StatusOK, c.GetString("username"))
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "https://kitchen.secure-proxy.lan/orders", nil)
+			req.Header.Set("Authorization", tt.authorization)
+			if tt.cookie {
+				req.AddCookie(&http.Cookie{Name: "secure_proxy_session", Value: "cashier-tablet"})
+			}
+			rec := httptest.NewRecorder()
+			engine.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("статус = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusOK && (gotHeader != tt.wantHeader || rec.Body.String() != "cashier") {
+				t.Errorf("upstream получил Authorization %q и пользователя %q", gotHeader, rec.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+// Package main - проверка TOTP кодов.
+// Содержит настройки проверки кодов и защиту от повторного использования одного кода.
+package main
+
+import (
+	"context"
+	"encoding/base32"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"github.com/valkey-io/valkey-go"
+)
+
+const (
+	userTOTPLastStepPrefix  = "user:totp:last:"
+	userTOTPQRPendingPrefix = "user:totp:qr:"
+
+	defaultTOTPPeriod       = 30
+	defaultTOTPSkew         = 1
+	defaultTOTPDigits       = 6
+	defaultTOTPIssuer       = "Secure Proxy"
+	defaultTOTPAccountLabel = "{username}"
+
+	// Время, в течение которого после создания или сброса секрета можно один раз получить QR код
+	totpQRPendingSeconds = 600
+)
+
+// acceptTOTPStepScript атомарно запоминает шаг времени, если он новее последнего принятого.
+// Возвращает 1, если шаг принят, и 0, если код с этим или более ранним шагом уже использовался.
+var acceptTOTPStepScript = valkey.NewLuaScript(`
+local last = tonumber(redis.call('GET', KEYS[1]) or '-1')
+local step = tonumber(ARGV[1])
+if step <= last then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1], 'EX', ARGV[2])
+return 1
+`)
+
+// getUserTOTPLastStepKey возвращает ключ последнего принятого шага TOTP пользователя
+func getUserTOTPLastStepKey(username string) string {
+	return userTOTPLastStepPrefix + username
+}
+
+// getUserTOTPQRPendingKey возвращает ключ разрешения на однократную выдачу QR кода
+func getUserTOTPQRPendingKey(username string) string {
+	return userTOTPQRPendingPrefix + username
+}
+
+// getTOTPValidateOpts возвращает параметры проверки TOTP из конфигурации
+func getTOTPValidateOpts() totp.ValidateOpts {
+	opts := totp.ValidateOpts{
+		Period:    defaultTOTPPeriod,
+		Skew:      defaultTOTPSkew,
+		Digits:    otp.Digits(defaultTOTPDigits),
+		Algorithm: otp.AlgorithmSHA1,
+	}
+	if config == nil {
+		return opts
+	}
+	if config.Security.TOTP.Period > 0 {
+		opts.Period = uint(config.Security.TOTP.Period)
+	}
+	if config.Security.TOTP.Skew != nil && *config.Security.TOTP.Skew >= 0 {
+		opts.Skew = uint(*config.Security.TOTP.Skew)
+	}
+	if config.Security.TOTP.Digits > 0 {
+		opts.Digits = otp.Digits(config.Security.TOTP.Digits)
+	}
+	return opts
+}
+
+// matchTOTPStep ищет шаг времени в пределах допустимого отклонения, для которого код верен
+func matchTOTPStep(code, secret string, now time.Time, opts totp.ValidateOpts) (int64, bool, error) {
+	period := int64(opts.Period)
+	current := now.Unix() / period
+
+	// Проверяем каждый шаг отдельно, чтобы знать, какой именно шаг принят
+	stepOpts := opts
+	stepOpts.Skew = 0
+	for i := -int64(opts.Skew); i <= int64(opts.Skew); i++ {
+		step := current + i
+		valid, err := totp.ValidateCustom(code, secret, time.Unix(step*period, 0), stepOpts)
+		if err != nil {
+			return 0, false, err
+		}
+		if valid {
+			return step, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// ValidateUserTOTP проверяет код пользователя и отклоняет повторное использование уже принятого кода.
+// Второе значение сообщает, что код верен, но уже был использован.
+func ValidateUserTOTP(username, code, secret string) (bool, bool, error) {
+	opts := getTOTPValidateOpts()
+	step, valid, err := matchTOTPStep(code, secret, time.Now(), opts)
+	if err != nil || !valid {
+		return false, false, err
+	}
+
+	// Хранить шаг дольше окна проверки не нужно: более старые коды уже не пройдут проверку
+	ttl := int64(opts.Period) * (2*int64(opts.Skew) + 2)
+	ctx := context.Background()
+	accepted, err := acceptTOTPStepScript.Exec(ctx, valkeyClient,
+		[]string{getUserTOTPLastStepKey(username)},
+		[]string{strconv.FormatInt(step, 10), strconv.FormatInt(ttl, 10)},
+	).AsInt64()
+	if err != nil {
+		return false, false, fmt.Errorf("ошибка проверки повторного использования TOTP: %v", err)
+	}
+
+	return accepted == 1, accepted != 1, nil
+}
+
+func getTOTPIssuer() string {
+	if config != nil && config.Security.TOTP.Issuer != "" {
+		return config.Security.TOTP.Issuer
+	}
+	return defaultTOTPIssuer
+}
+
+// getTOTPAccountName подставляет имя пользователя в шаблон метки учетной записи
+func getTOTPAccountName(username string) string {
+	label := defaultTOTPAccountLabel
+	if config != nil && config.Security.TOTP.AccountLabel != "" {
+		label = config.Security.TOTP.AccountLabel
+	}
+	return strings.ReplaceAll(label, "{username}", username)
+}
+
+// buildTOTPKey собирает otpauth ключ пользователя с эмитентом и параметрами из конфигурации
+func buildTOTPKey(username, secret string) (*otp.Key, error) {
+	rawSecret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return nil, fmt.Errorf("некорректный TOTP секрет: %v", err)
+	}
+
+	opts := getTOTPValidateOpts()
+	return totp.Generate(totp.GenerateOpts{
+		Issuer:      getTOTPIssuer(),
+		AccountName: getTOTPAccountName(username),
+		Period:      opts.Period,
+		Secret:      rawSecret,
+		Digits:      opts.Digits,
+		Algorithm:   opts.Algorithm,
+	})
+}
+
+// AllowTOTPQR разрешает однократное получение QR кода после выдачи нового секрета
+func AllowTOTPQR(username string) error {
+	ctx := context.Background()
+	return valkeyClient.Do(ctx, valkeyClient.B().Set().Key(getUserTOTPQRPendingKey(username)).Value("1").ExSeconds(totpQRPendingSeconds).Build()).Error()
+}
+
+// ConsumeTOTPQR проверяет и снимает разрешение на получение QR кода
+func ConsumeTOTPQR(username string) bool {
+	ctx := context.Background()
+	err := valkeyClient.Do(ctx, valkeyClient.B().Getdel().Key(getUserTOTPQRPendingKey(username)).Build()).Error()
+	return err == nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+func TestMatchTOTPStep(t *testing.T) {
+	secret := "VGLFTEMMJYNRCC36PNS6ZCURQPLYAXRY"
+	opts := totp.ValidateOpts{Period: 30, Skew: 1, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1}
+	now := time.Unix(1700000000, 0)
+	current := now.Unix() / 30
+
+	tests := []struct {
+		name      string
+		codeAt    time.Time
+		wantStep  int64
+		wantValid bool
+	}{
+		{"текущий шаг", now, current, true},
+		{"предыдущий шаг в пределах skew", now.Add(-30 * time.Second), current - 1, true},
+		{"следующий шаг в пределах skew", now.Add(30 * time.Second), current + 1, true},
+		{"шаг за пределами skew", now.Add(-90 * time.Second), 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, err := totp.GenerateCodeCustom(secret, tt.codeAt, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			step, valid, err := matchTOTPStep(code, secret, now, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if valid != tt.wantValid || step != tt.wantStep {
+				t.Errorf("matchTOTPStep() = (%d, %v), want (%d, %v)", step, valid, tt.wantStep, tt.wantValid)
+			}
+		})
+	}
+}
+
+func TestBuildTOTPKey(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+
+	config = &Config{Security: SecurityConfig{TOTP: TOTPConfig{
+		Issuer:       "MIIT",
+		AccountLabel: "{username}@secure-proxy.lan",
+	}}}
+
+	secret := "VGLFTEMMJYNRCC36PNS6ZCURQPLYAXRY"
+	key, err := buildTOTPKey("sklad", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if key.Issuer() != "MIIT" {
+		t.Errorf("Issuer() = %q, want %q", key.Issuer(), "MIIT")
+	}
+	if key.AccountName() != "sklad@secure-proxy.lan" {
+		t.Errorf("AccountName() = %q, want %q", key.AccountName(), "sklad@secure-proxy.lan")
+	}
+	if key.Secret() != secret {
+		t.Errorf("Secret() = %q, want %q", key.Secret(), secret)
+	}
+	if key.Period() != defaultTOTPPeriod || key.Digits() != otp.DigitsSix {
+		t.Errorf("period/digits = %d/%d, want %d/%d", key.Period(), key.Digits(), defaultTOTPPeriod, otp.DigitsSix)
+	}
+}
+
+func TestValidateUserTOTPRejectsReplay(t *testing.T) {
+	setupTestValkey(t)
+	saved := config
+	defer func() { config = saved }()
+	// Запас в skew, чтобы смена шага во время теста не делала коды недействительными
+	skew := 2
+	config = &Config{Security: SecurityConfig{TOTP: TOTPConfig{Skew: &skew}}}
+
+	secret := "VGLFTEMMJYNRCC36PNS6ZCURQPLYAXRY"
+	opts := getTOTPValidateOpts()
+	now := time.Now()
+
+	// Проверки идут по порядку: каждая видит шаг, принятый предыдущими
+	tests := []struct {
+		name         string
+		codeAt       time.Time
+		wantValid    bool
+		wantReplayed bool
+	}{
+		{"код предыдущего шага", now.Add(-30 * time.Second), true, false},
+		{"код текущего шага", now, true, false},
+		{"повтор текущего кода", now, false, true},
+		{"код более раннего шага, чем принятый", now.Add(-30 * time.Second), false, true},
+		{"код за пределами skew", now.Add(-5 * time.Minute), false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, err := totp.GenerateCodeCustom(secret, tt.codeAt, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			valid, replayed, err := ValidateUserTOTP("sklad", code, secret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if valid != tt.wantValid || replayed != tt.wantReplayed {
+				t.Errorf("ValidateUserTOTP() = (%v, %v), want (%v, %v)", valid, replayed, tt.wantValid, tt.wantReplayed)
+			}
+		})
+	}
+
+	// Шаг принятого кода учитывается отдельно для каждого пользователя
+	code, _ := totp.GenerateCodeCustom(secret, now, opts)
+	if valid, _, err := ValidateUserTOTP("kitchen", code, secret); err != nil || !valid {
+		t.Errorf("код другого пользователя отклонен: %v, %v", valid, err)
+	}
+}
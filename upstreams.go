@@ -0,0 +1,550 @@
+// Package main - реестр upstream серверов.
+// Для каждого upstream один раз (при запуске или перезагрузке) создаются ReverseProxy
+// и настроенный http.Transport с пулом keep-alive соединений; поиск по хосту - через map.
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Параметры транспорта по умолчанию
+const (
+	defaultUpstreamMaxIdleConns                 = 100
+	defaultUpstreamMaxIdleConnsPerHost          = 32
+	defaultUpstreamIdleConnTimeoutSeconds       = 90
+	defaultUpstreamDialTimeoutSeconds           = 5
+	defaultUpstreamKeepAliveSeconds             = 30
+	defaultUpstreamTLSHandshakeTimeoutSeconds   = 10
+	defaultUpstreamResponseHeaderTimeoutSeconds = 30
+)
+
+// upstreamProxy - готовый к работе upstream: адреса с балансировщиком, транспорт и прокси
+type upstreamProxy struct {
+	config    UpstreamConfig
+	balancer  *loadBalancer
+	breaker   *circuitBreaker
+	retry     *retryPolicy
+	rewriter  *pathRewriter
+	transport *http.Transport
+	proxy     *httputil.ReverseProxy
+
+	// Подпись заголовков личности и все заголовки JWT, клиентские копии которых удаляются
+	signer          *identitySigner
+	identityHeaders []string
+
+	// Активные проверки адресов, nil - проверки выключены
+	healthCheck   *healthCheckSettings
+	healthChecker *healthChecker
+}
+
+// upstreamRegistry - неизменяемый набор upstream, заменяется целиком при перезагрузке
+type upstreamRegistry struct {
+	byHost map[string]*upstreamProxy
+}
+
+var currentUpstreams atomic.Pointer[upstreamRegistry]
+
+// upstreamConfigsMu защищает config.Upstreams, который заменяется при перезагрузке upstream
+var upstreamConfigsMu sync.RWMutex
+
+// getUpstreamConfigs возвращает настройки upstream из текущей конфигурации
+func getUpstreamConfigs() []UpstreamConfig {
+	upstreamConfigsMu.RLock()
+	defer upstreamConfigsMu.RUnlock()
+	if config == nil {
+		return nil
+	}
+	return config.Upstreams
+}
+
+// proxyAttempt - состояние одного запроса к upstream: выбранный адрес и результат.
+// Передается директору и обработчикам ответа общего прокси через контекст запроса.
+type proxyAttempt struct {
+	c           *gin.Context
+	destination *destination
+	status      int
+	err         error
+
+	// Пробный запрос полуоткрытого выключателя
+	probe bool
+	// retryable - при сбое запрос можно повторить, retry - ответ не отправлен клиенту, запрос будет повторен
+	retryable bool
+	retry     bool
+
+	// Тело запроса клиента и признак ошибки по вине клиента (408, 413), которая не считается сбоем upstream
+	body        *requestBody
+	clientError bool
+	// Общий таймаут запроса, снимается при передаче ответа клиенту
+	timeout *requestTimeout
+}
+
+type proxyAttemptKey struct{}
+
+// secondsOrDefault переводит секунды из конфигурации в длительность, 0 - значение по умолчанию
+func secondsOrDefault(seconds, fallback int) time.Duration {
+	if seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return time.Duration(fallback) * time.Second
+}
+
+func intOrDefault(value, fallback int) int {
+	if value > 0 {
+		return value
+	}
+	return fallback
+}
+
+// newUpstreamTransport создает транспорт по настройкам upstream
+func newUpstreamTransport(cfg UpstreamTransportConfig) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   secondsOrDefault(cfg.DialTimeoutSeconds, defaultUpstreamDialTimeoutSeconds),
+		KeepAlive: secondsOrDefault(cfg.KeepAliveSeconds, defaultUpstreamKeepAliveSeconds),
+	}
+
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     cfg.HTTP2 == nil || *cfg.HTTP2,
+		MaxIdleConns:          intOrDefault(cfg.MaxIdleConns, defaultUpstreamMaxIdleConns),
+		MaxIdleConnsPerHost:   intOrDefault(cfg.MaxIdleConnsPerHost, defaultUpstreamMaxIdleConnsPerHost),
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		IdleConnTimeout:       secondsOrDefault(cfg.IdleConnTimeoutSeconds, defaultUpstreamIdleConnTimeoutSeconds),
+		TLSHandshakeTimeout:   secondsOrDefault(cfg.TLSHandshakeTimeoutSeconds, defaultUpstreamTLSHandshakeTimeoutSeconds),
+		ResponseHeaderTimeout: secondsOrDefault(cfg.ResponseHeaderTimeoutSeconds, defaultUpstreamResponseHeaderTimeoutSeconds),
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+// destinationConfigs возвращает адреса upstream в единой форме
+func destinationConfigs(cfg UpstreamConfig) ([]DestinationConfig, error) {
+	if cfg.Destination != "" && len(cfg.Destinations) > 0 {
+		return nil, fmt.Errorf("укажите destination или destinations, но не оба")
+	}
+	if cfg.Destination != "" {
+		return []DestinationConfig{{URL: cfg.Destination}}, nil
+	}
+	if len(cfg.Destinations) == 0 {
+		return nil, fmt.Errorf("не указан destination")
+	}
+	return cfg.Destinations, nil
+}
+
+// newDestinations разбирает адреса upstream
+func newDestinations(cfg UpstreamConfig) ([]*destination, error) {
+	configs, err := destinationConfigs(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	destinations := make([]*destination, 0, len(configs))
+	for _, destinationConfig := range configs {
+		target, err := url.Parse(destinationConfig.URL)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка разбора destination: %v", err)
+		}
+		if target.Scheme != "http" && target.Scheme != "https" || target.Host == "" {
+			return nil, fmt.Errorf("destination должен быть http(s) адресом, указано %q", destinationConfig.URL)
+		}
+		if destinationConfig.Weight < 0 {
+			return nil, fmt.Errorf("вес destination %s не может быть отрицательным", destinationConfig.URL)
+		}
+
+		destinations = append(destinations, &destination{
+			url:    target,
+			weight: intOrDefault(destinationConfig.Weight, 1),
+		})
+	}
+	return destinations, nil
+}
+
+// newUpstreamProxy создает прокси для upstream
+func newUpstreamProxy(cfg UpstreamConfig) (*upstreamProxy, error) {
+	destinations, err := newDestinations(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	upstream := &upstreamProxy{
+		config:    cfg,
+		balancer:  newLoadBalancer(destinations, cfg.LoadBalancing),
+		breaker:   newCircuitBreaker(cfg.CircuitBreaker),
+		retry:     newRetryPolicy(cfg.Retry),
+		transport: newUpstreamTransport(cfg.Transport),
+	}
+
+	upstream.rewriter, err = newPathRewriter(cfg.Rewrite)
+	if err != nil {
+		return nil, err
+	}
+
+	upstream.healthCheck, err = newHealthCheckSettings(cfg.HealthCheck)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range destinations {
+		d.health.enabled = upstream.healthCheck != nil
+	}
+
+	if cfg.Identity.Enabled && cfg.Identity.JWT.Algorithm != "" {
+		upstream.signer, err = newIdentitySigner(cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	upstream.proxy = &httputil.ReverseProxy{
+		Transport:      upstream.transport,
+		ModifyResponse: upstream.recordResponse,
+		ErrorHandler:   upstream.handleError,
+	}
+	configureProxyDirector(upstream.proxy, upstream)
+	return upstream, nil
+}
+
+// buildUpstreamRegistry создает прокси для всех upstream из конфигурации
+func buildUpstreamRegistry(configs []UpstreamConfig) (*upstreamRegistry, error) {
+	registry := &upstreamRegistry{byHost: make(map[string]*upstreamProxy, len(configs))}
+	identityHeaders := []string{defaultIdentityTokenHeader}
+
+	for _, cfg := range configs {
+		host := strings.ToLower(cfg.Host)
+		if _, exists := registry.byHost[host]; exists {
+			return nil, fmt.Errorf("upstream %s указан повторно", cfg.Host)
+		}
+
+		upstream, err := newUpstreamProxy(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %v", cfg.Host, err)
+		}
+		if upstream.signer != nil {
+			identityHeaders = append(identityHeaders, upstream.signer.header)
+		}
+		registry.byHost[host] = upstream
+	}
+
+	for _, upstream := range registry.byHost {
+		upstream.identityHeaders = identityHeaders
+	}
+	return registry, nil
+}
+
+// LoadUpstreams создает прокси для upstream и атомарно заменяет ими текущие.
+// Используется при запуске и при перезагрузке: запросы в процессе дорабатывают на старых прокси,
+// простаивающие соединения старых транспортов закрываются.
+func LoadUpstreams(configs []UpstreamConfig) error {
+	registry, err := buildUpstreamRegistry(configs)
+	if err != nil {
+		return err
+	}
+
+	for _, upstream := range registry.byHost {
+		if upstream.healthCheck != nil {
+			upstream.healthChecker = newHealthChecker(upstream, upstream.healthCheck)
+			upstream.healthChecker.start()
+		}
+	}
+
+	closeUpstreams(currentUpstreams.Swap(registry))
+	return nil
+}
+
+// closeUpstreams останавливает проверки и закрывает простаивающие соединения замененного реестра
+func closeUpstreams(registry *upstreamRegistry) {
+	if registry == nil {
+		return
+	}
+	for _, upstream := range registry.byHost {
+		if upstream.healthChecker != nil {
+			upstream.healthChecker.shutdown()
+		}
+		upstream.transport.CloseIdleConnections()
+	}
+}
+
+// reloadUpstreams заменяет реестр upstream и список upstream в конфигурации. Список хостов
+// нужен проверке адресов перенаправления и хосту по умолчанию, поэтому обновляется вместе с реестром.
+func reloadUpstreams(configs []UpstreamConfig) error {
+	upstreamConfigsMu.Lock()
+	defer upstreamConfigsMu.Unlock()
+
+	if err := LoadUpstreams(configs); err != nil {
+		return err
+	}
+	config.Upstreams = configs
+	return nil
+}
+
+// watchUpstreamReload перечитывает секцию upstreams из config.yaml по сигналу SIGHUP.
+// Остальные настройки (сессии, доступ, безопасность) применяются только при перезапуске.
+func watchUpstreamReload() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		newConfig, err := ReadConfig()
+		if err != nil {
+			log.Printf("Перезагрузка upstream отменена, ошибка чтения конфигурации: %v", err)
+			continue
+		}
+		if err := reloadUpstreams(newConfig.Upstreams); err != nil {
+			log.Printf("Перезагрузка upstream отменена: %v", err)
+			continue
+		}
+		log.Printf("Upstream перезагружены: %d", len(newConfig.Upstreams))
+	}
+}
+
+// lookupUpstream находит upstream по хосту запроса (без порта)
+func lookupUpstream(host string) *upstreamProxy {
+	registry := currentUpstreams.Load()
+	if registry == nil {
+		return nil
+	}
+	return registry.byHost[strings.ToLower(host)]
+}
+
+// serveUpstream выбирает адрес upstream и проксирует на него запрос, при сбое повторяя безопасные запросы.
+// Состояние запроса передается директору и обработчикам ответа через контекст запроса.
+func serveUpstream(c *gin.Context, upstream *upstreamProxy) {
+	if maxBytes := upstream.getMaxRequestBodyBytes(); maxBytes > 0 && c.Request.ContentLength > maxBytes {
+		renderProxyError(c, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	now := time.Now()
+	allowed, probe, retryAfter := upstream.breaker.allow(now)
+	if !allowed {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		renderProxyError(c, http.StatusServiceUnavailable)
+		return
+	}
+
+	requestBody, timeout := upstream.limitRequest(c)
+	defer timeout.release()
+
+	// Пробный запрос выключателя не повторяется: его сбой должен сразу разомкнуть выключатель
+	attempts := 0
+	var body []byte
+	if upstream.retry.attempts > 0 && !probe && isRetryableRequest(c.Request) {
+		var buffered bool
+		if body, buffered = bufferRetryBody(c.Request); buffered {
+			attempts = upstream.retry.attempts
+			upstream.retry.budget.recordRequest(now)
+		}
+	}
+
+	var tried []*destination
+	for retry := 0; ; retry++ {
+		if retry > 0 && !waitRetry(c.Request.Context(), upstream.retry.delay(retry)) {
+			status := http.StatusBadGateway
+			if isRequestTimedOut(c.Request.Context()) {
+				status = http.StatusGatewayTimeout
+			}
+			renderProxyError(c, status)
+			return
+		}
+		if body != nil {
+			c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		attempt := &proxyAttempt{
+			c:           c,
+			destination: upstream.balancer.pickExcept(time.Now(), tried),
+			probe:       probe,
+			retryable:   retry < attempts,
+			body:        requestBody,
+			timeout:     timeout,
+		}
+		tried = append(tried, attempt.destination)
+		upstream.serveAttempt(attempt)
+		if !attempt.retry {
+			return
+		}
+	}
+}
+
+// serveAttempt проксирует запрос на выбранный адрес и учитывает результат попытки.
+// ReverseProxy паникует с http.ErrAbortHandler, если передача тела ответа оборвалась:
+// счетчик активных запросов и результат попытки все равно обновляются,
+// иначе least_connections обходил бы адрес, а пробный запрос навсегда занимал бы выключатель.
+func (u *upstreamProxy) serveAttempt(attempt *proxyAttempt) {
+	attempt.destination.requests.Add(1)
+	attempt.destination.active.Add(1)
+	defer func() {
+		attempt.destination.active.Add(-1)
+		recovered := recover()
+		if recovered != nil {
+			attempt.err = http.ErrAbortHandler
+			attempt.retry = false
+		}
+		u.recordAttempt(attempt)
+		if recovered != nil {
+			panic(recovered)
+		}
+	}()
+
+	ctx := context.WithValue(attempt.c.Request.Context(), proxyAttemptKey{}, attempt)
+	u.proxy.ServeHTTP(attempt.c.Writer, attempt.c.Request.WithContext(ctx))
+}
+
+// proxyAttemptFromRequest возвращает состояние запроса к upstream
+func proxyAttemptFromRequest(req *http.Request) *proxyAttempt {
+	attempt, _ := req.Context().Value(proxyAttemptKey{}).(*proxyAttempt)
+	return attempt
+}
+
+// recordResponse запоминает статус ответа upstream для пассивной проверки адреса
+// и переводит пути в заголовках ответа в пути клиента.
+// Ответ 502/503/504 на запрос, который можно повторить, не передается клиенту.
+func (u *upstreamProxy) recordResponse(resp *http.Response) error {
+	attempt := proxyAttemptFromRequest(resp.Request)
+	if attempt == nil {
+		return nil
+	}
+
+	attempt.status = resp.StatusCode
+	if upstreamFailureReason(nil, resp.StatusCode) != "" && u.shouldRetry(attempt) {
+		return errRetryableStatus
+	}
+	attempt.timeout.headersReceived()
+	u.rewriter.rewriteResponse(resp, attempt.destination.url, proxyAuthority(attempt.c.Request.Host))
+	return nil
+}
+
+// handleError запоминает ошибку запроса к upstream и, если запрос не будет повторен,
+// отвечает страницей или JSON ошибкой со статусом 408, 413, 502 или 504
+func (u *upstreamProxy) handleError(w http.ResponseWriter, req *http.Request, err error) {
+	attempt := proxyAttemptFromRequest(req)
+	if attempt == nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	if errors.Is(err, errRetryableStatus) {
+		return
+	}
+
+	// Истечение общего таймаута транспорт может вернуть как отмену контекста
+	if isRequestTimedOut(req.Context()) {
+		err = context.DeadlineExceeded
+	}
+	attempt.err = err
+	status := upstreamErrorStatus(err, attempt.body)
+	if status == http.StatusRequestTimeout || status == http.StatusRequestEntityTooLarge {
+		attempt.clientError = true
+		renderProxyError(attempt.c, status)
+		return
+	}
+
+	log.Printf("Ошибка запроса к upstream %s: %v", attempt.destination.url.Host, err)
+	if !errors.Is(err, context.Canceled) && u.shouldRetry(attempt) {
+		return
+	}
+	renderProxyError(attempt.c, status)
+}
+
+// shouldRetry решает, повторить ли неудачный запрос, и расходует на повтор бюджет upstream.
+// После истечения общего таймаута запрос не повторяется.
+func (u *upstreamProxy) shouldRetry(attempt *proxyAttempt) bool {
+	if !attempt.retryable || attempt.c.Request.Context().Err() != nil || !u.retry.budget.withdraw(time.Now()) {
+		return false
+	}
+	attempt.retry = true
+	log.Printf("Повтор запроса %s %s к upstream %s после сбоя адреса %s",
+		attempt.c.Request.Method, attempt.c.Request.URL.Path, u.config.Host, attempt.destination.url.Host)
+	return true
+}
+
+// upstreamFailureReason определяет, считается ли результат запроса сбоем адреса upstream
+func upstreamFailureReason(err error, status int) string {
+	if err != nil {
+		return err.Error()
+	}
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return fmt.Sprintf("HTTP %d", status)
+	}
+	return ""
+}
+
+// recordAttempt обновляет состояние адреса и выключателя по результату запроса
+func (u *upstreamProxy) recordAttempt(attempt *proxyAttempt) {
+	// Клиент закрыл соединение сам или нарушил ограничения запроса - это не сбой upstream.
+	// При обрыве тела ответа неизвестно, чья сторона закрыла соединение, поэтому он тоже не учитывается.
+	if errors.Is(attempt.err, context.Canceled) || errors.Is(attempt.err, http.ErrAbortHandler) || attempt.clientError {
+		if attempt.probe {
+			u.breaker.abandon()
+		}
+		return
+	}
+
+	reason := upstreamFailureReason(attempt.err, attempt.status)
+	if reason == "" {
+		attempt.destination.recordSuccess()
+		if u.breaker.recordSuccess() {
+			log.Printf("Выключатель upstream %s замкнут, сервис снова отвечает", u.config.Host)
+		}
+		return
+	}
+
+	if u.breaker.recordFailure(time.Now()) {
+		log.Printf("Выключатель upstream %s разомкнут на %v: %s", u.config.Host, u.breaker.cooldown, reason)
+	}
+
+	if attempt.destination.recordFailure(reason, time.Now(), u.balancer.maxFails, u.balancer.ejectFor) {
+		log.Printf("Адрес %s upstream %s исключен из ротации на %v: %s",
+			attempt.destination.url.Host, u.config.Host, u.balancer.ejectFor, reason)
+	}
+}
+
+// UpstreamStats - состояние upstream для API управления
+type UpstreamStats struct {
+	Host         string             `json:"host"`
+	Strategy     string             `json:"strategy"`
+	Circuit      CircuitStats       `json:"circuit"`
+	Retries      uint64             `json:"retries"`
+	Destinations []DestinationStats `json:"destinations"`
+}
+
+// GetUpstreamStats возвращает статистику всех upstream, отсортированную по хосту
+func GetUpstreamStats() []UpstreamStats {
+	stats := []UpstreamStats{}
+	registry := currentUpstreams.Load()
+	if registry == nil {
+		return stats
+	}
+
+	now := time.Now()
+	for _, upstream := range registry.byHost {
+		stats = append(stats, UpstreamStats{
+			Host:         upstream.config.Host,
+			Strategy:     upstream.balancer.strategy,
+			Circuit:      upstream.breaker.stats(),
+			Retries:      upstream.retry.budget.total.Load(),
+			Destinations: upstream.balancer.stats(now),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Host < stats[j].Host })
+	return stats
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/valkey-io/valkey-go"
+)
+
+// setupTestValkey запускает совместимый с Valkey сервер в памяти и подменяет им глобальный клиент
+func setupTestValkey(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	server := miniredis.RunT(t)
+
+	client, err := valkey.NewClient(valkey.ClientOption{
+		InitAddress: []string{server.Addr()},
+		// miniredis отвечает на CLUSTER SLOTS, а в работе используется одиночный Valkey
+		ForceSingleClient: true,
+		DisableCache:      true,
+	})
+	if err != nil {
+		t.Fatalf("ошибка подключения к тестовому Valkey: %v", err)
+	}
+
+	saved := valkeyClient
+	valkeyClient = client
+	t.Cleanup(func() {
+		client.Close()
+		valkeyClient = saved
+	})
+	return server
+}